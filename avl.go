@@ -1,15 +1,10 @@
 package main
 
-import (
-	"encoding/json"
-	"errors"
-	"os"
-)
-
 type Node struct {
 	Key    string
 	Value  interface{}
 	Height int
+	Size   int
 	Left   *Node
 	Right  *Node
 }
@@ -23,9 +18,12 @@ func NewAVLTree() *AVLTree {
 }
 
 func (tree *AVLTree) Insert(key string, value interface{}) error {
-	var err error
-	tree.Root, err = insert(tree.Root, key, value)
-	return err
+	root, err := insert(tree.Root, key, value)
+	if err != nil {
+		return err
+	}
+	tree.Root = root
+	return nil
 }
 
 func (tree *AVLTree) Get(key string) (interface{}, error) {
@@ -57,6 +55,155 @@ func (tree *AVLTree) GetRange(minValue, maxValue string) ([]string, error) {
 	return result, nil
 }
 
+func (tree *AVLTree) Range(query RangeQuery) ([]KeyValue, error) {
+	collector := newRangeCollector(query)
+	var rangeHelper func(node *Node) bool
+	rangeHelper = func(node *Node) bool {
+		if node == nil {
+			return true
+		}
+		first, second := node.Left, node.Right
+		goFirst, goSecond := query.hasLess(node.Key), query.hasGreater(node.Key)
+		if query.Descending {
+			first, second = second, first
+			goFirst, goSecond = goSecond, goFirst
+		}
+		if goFirst && !rangeHelper(first) {
+			return false
+		}
+		if query.Contains(node.Key) && !collector.add(node.Key, node.Value) {
+			return false
+		}
+		return !goSecond || rangeHelper(second)
+	}
+	rangeHelper(tree.Root)
+	return collector.result, nil
+}
+
+// avlIterator keeps the path from the root to the current node.
+type avlIterator struct {
+	tree *AVLTree
+	path []*Node
+}
+
+func (tree *AVLTree) NewIterator() Iterator {
+	return &avlIterator{tree: tree}
+}
+
+func (it *avlIterator) Seek(key string) bool {
+	it.path = it.path[:0]
+	found := -1
+	for node := it.tree.Root; node != nil; {
+		it.path = append(it.path, node)
+		if key == node.Key {
+			return true
+		}
+		if key < node.Key {
+			found = len(it.path) - 1
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+	it.path = it.path[:found+1]
+	return found >= 0
+}
+
+func (it *avlIterator) descend(node *Node, toLeft bool) {
+	for node != nil {
+		it.path = append(it.path, node)
+		if toLeft {
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+}
+
+func (it *avlIterator) Next() bool {
+	if len(it.path) == 0 {
+		it.descend(it.tree.Root, true)
+		return len(it.path) > 0
+	}
+	if right := it.path[len(it.path)-1].Right; right != nil {
+		it.descend(right, true)
+		return true
+	}
+	for {
+		child := it.path[len(it.path)-1]
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) == 0 {
+			return false
+		}
+		if it.path[len(it.path)-1].Left == child {
+			return true
+		}
+	}
+}
+
+func (it *avlIterator) Prev() bool {
+	if len(it.path) == 0 {
+		it.descend(it.tree.Root, false)
+		return len(it.path) > 0
+	}
+	if left := it.path[len(it.path)-1].Left; left != nil {
+		it.descend(left, false)
+		return true
+	}
+	for {
+		child := it.path[len(it.path)-1]
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) == 0 {
+			return false
+		}
+		if it.path[len(it.path)-1].Right == child {
+			return true
+		}
+	}
+}
+
+func (it *avlIterator) Key() string {
+	return it.path[len(it.path)-1].Key
+}
+
+func (it *avlIterator) Value() interface{} {
+	return it.path[len(it.path)-1].Value
+}
+
+func (it *avlIterator) Close() {
+	it.path = nil
+}
+
+func (tree *AVLTree) Count(minValue, maxValue string) (int, error) {
+	if minValue > maxValue {
+		return 0, nil
+	}
+	return countLess(tree.Root, maxValue, true) - countLess(tree.Root, minValue, false), nil
+}
+
+func (tree *AVLTree) Rank(key string) (int, error) {
+	return countLess(tree.Root, key, false), nil
+}
+
+func (tree *AVLTree) Select(position int) (KeyValue, error) {
+	if position < 0 || position >= size(tree.Root) {
+		return KeyValue{}, positionNotFound(position)
+	}
+	node := tree.Root
+	for {
+		left := size(node.Left)
+		switch {
+		case position < left:
+			node = node.Left
+		case position > left:
+			position -= left + 1
+			node = node.Right
+		default:
+			return KeyValue{Key: node.Key, Value: node.Value}, nil
+		}
+	}
+}
+
 func (tree *AVLTree) Update(key string, value interface{}) error {
 	node, err := getNode(tree.Root, key)
 	if err != nil {
@@ -67,25 +214,89 @@ func (tree *AVLTree) Update(key string, value interface{}) error {
 }
 
 func (tree *AVLTree) Remove(key string) error {
-	var err error
-	tree.Root, err = deleteNode(tree.Root, key)
-	return err
+	root, err := deleteNode(tree.Root, key)
+	if err != nil {
+		return err
+	}
+	tree.Root = root
+	return nil
 }
 
-func (tree *AVLTree) SaveToFile(filename string) error {
-	data, err := json.Marshal(tree)
-	if err != nil {
+// BulkLoad replaces the tree with one built from sorted pairs in O(n): the
+// middle pair of every slice becomes the root of its subtree.
+func (tree *AVLTree) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
 		return err
 	}
-	return os.WriteFile(filename, data, 0644)
+	tree.Root = buildAVL(pairs)
+	return nil
 }
 
-func (tree *AVLTree) LoadFromFile(filename string) error {
-	data, err := os.ReadFile(filename)
+func buildAVL(pairs []KeyValue) *Node {
+	if len(pairs) == 0 {
+		return nil
+	}
+	mid := len(pairs) / 2
+	node := &Node{Key: pairs[mid].Key, Value: pairs[mid].Value}
+	node.Left = buildAVL(pairs[:mid])
+	node.Right = buildAVL(pairs[mid+1:])
+	node.Height = max(height(node.Left), height(node.Right)) + 1
+	node.Size = len(pairs)
+	return node
+}
+
+// Validate checks key order, heights, balance factors and subtree sizes.
+func (tree *AVLTree) Validate() error {
+	_, err := validateAVL(tree.Root, "root", nil, nil)
+	return err
+}
+
+func validateAVL(node *Node, path string, low, high *string) (int, error) {
+	if node == nil {
+		return 0, nil
+	}
+	if low != nil && node.Key <= *low || high != nil && node.Key >= *high {
+		return 0, corruptedAt(path, "ключ %s нарушает порядок", node.Key)
+	}
+	left, err := validateAVL(node.Left, path+".L", low, &node.Key)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	right, err := validateAVL(node.Right, path+".R", &node.Key, high)
+	if err != nil {
+		return 0, err
+	}
+	if expected := max(left, right) + 1; node.Height != expected {
+		return 0, corruptedAt(path, "высота %d, ожидалась %d", node.Height, expected)
+	}
+	if balance := left - right; balance > 1 || balance < -1 {
+		return 0, corruptedAt(path, "баланс %d", balance)
+	}
+	if expected := size(node.Left) + size(node.Right) + 1; node.Size != expected {
+		return 0, corruptedAt(path, "размер поддерева %d, ожидался %d", node.Size, expected)
 	}
-	return json.Unmarshal(data, tree)
+	return node.Height, nil
+}
+
+func (tree *AVLTree) Walk(fn func(key string, value interface{})) {
+	var walkHelper func(node *Node)
+	walkHelper = func(node *Node) {
+		if node == nil {
+			return
+		}
+		walkHelper(node.Left)
+		fn(node.Key, node.Value)
+		walkHelper(node.Right)
+	}
+	walkHelper(tree.Root)
+}
+
+func (tree *AVLTree) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "avl"}, tree)
+}
+
+func (tree *AVLTree) LoadFromFile(filename string) error {
+	return loadTreeFileInto(filename, tree)
 }
 
 func height(node *Node) int {
@@ -95,6 +306,28 @@ func height(node *Node) int {
 	return node.Height
 }
 
+func size(node *Node) int {
+	if node == nil {
+		return 0
+	}
+	return node.Size
+}
+
+// countLess returns how many keys are below key, or up to and including it
+// when inclusive is set.
+func countLess(node *Node, key string, inclusive bool) int {
+	count := 0
+	for node != nil {
+		if node.Key < key || inclusive && node.Key == key {
+			count += size(node.Left) + 1
+			node = node.Right
+		} else {
+			node = node.Left
+		}
+	}
+	return count
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -111,6 +344,8 @@ func rightRotate(y *Node) *Node {
 
 	y.Height = max(height(y.Left), height(y.Right)) + 1
 	x.Height = max(height(x.Left), height(x.Right)) + 1
+	y.Size = size(y.Left) + size(y.Right) + 1
+	x.Size = size(x.Left) + size(x.Right) + 1
 
 	return x
 }
@@ -124,6 +359,8 @@ func leftRotate(x *Node) *Node {
 
 	x.Height = max(height(x.Left), height(x.Right)) + 1
 	y.Height = max(height(y.Left), height(y.Right)) + 1
+	x.Size = size(x.Left) + size(x.Right) + 1
+	y.Size = size(y.Left) + size(y.Right) + 1
 
 	return y
 }
@@ -137,26 +374,27 @@ func getBalance(node *Node) int {
 
 func insert(node *Node, key string, value interface{}) (*Node, error) {
 	if node == nil {
-		return &Node{Key: key, Value: value, Height: 1}, nil
+		return &Node{Key: key, Value: value, Height: 1, Size: 1}, nil
 	}
 
 	if key < node.Key {
 		var err error
 		node.Left, err = insert(node.Left, key, value)
 		if err != nil {
-			return nil, err
+			return node, err
 		}
 	} else if key > node.Key {
 		var err error
 		node.Right, err = insert(node.Right, key, value)
 		if err != nil {
-			return nil, err
+			return node, err
 		}
 	} else {
-		return nil, errors.New("element with this key already exists")
+		return node, ErrKeyExists
 	}
 
 	node.Height = 1 + max(height(node.Left), height(node.Right))
+	node.Size = 1 + size(node.Left) + size(node.Right)
 
 	balance := getBalance(node)
 
@@ -191,20 +429,20 @@ func minValueNode(node *Node) *Node {
 
 func deleteNode(root *Node, key string) (*Node, error) {
 	if root == nil {
-		return root, errors.New("element not found")
+		return root, ErrKeyNotFound
 	}
 
 	if key < root.Key {
 		var err error
 		root.Left, err = deleteNode(root.Left, key)
 		if err != nil {
-			return nil, err
+			return root, err
 		}
 	} else if key > root.Key {
 		var err error
 		root.Right, err = deleteNode(root.Right, key)
 		if err != nil {
-			return nil, err
+			return root, err
 		}
 	} else {
 		if root.Left == nil || root.Right == nil {
@@ -228,7 +466,7 @@ func deleteNode(root *Node, key string) (*Node, error) {
 			var err error
 			root.Right, err = deleteNode(root.Right, temp.Key)
 			if err != nil {
-				return nil, err
+				return root, err
 			}
 		}
 	}
@@ -238,6 +476,7 @@ func deleteNode(root *Node, key string) (*Node, error) {
 	}
 
 	root.Height = max(height(root.Left), height(root.Right)) + 1
+	root.Size = size(root.Left) + size(root.Right) + 1
 
 	balance := getBalance(root)
 
@@ -264,7 +503,7 @@ func deleteNode(root *Node, key string) (*Node, error) {
 
 func getNode(node *Node, key string) (*Node, error) {
 	if node == nil {
-		return nil, errors.New("element not found")
+		return nil, ErrKeyNotFound
 	}
 
 	if key < node.Key {
@@ -337,17 +576,9 @@ func (avl *AVLCollection) Remove(key string) error {
 }
 
 func (avl *AVLCollection) SaveToFile(filename string) error {
-	data, err := json.Marshal(avl)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(filename, data, 0644)
+	return avl.Tree.SaveToFile(filename)
 }
 
 func (avl *AVLCollection) LoadFromFile(filename string) error {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, avl)
+	return avl.Tree.LoadFromFile(filename)
 }
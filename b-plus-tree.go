@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+)
+
+// NodeBPlus is a B+ tree node. Only leaves carry values; they are linked in
+// key order through Next and Prev. In an inner node Keys[i] is the smallest
+// key of the subtree Children[i+1].
+type NodeBPlus struct {
+	Keys     []string
+	Values   []interface{}
+	Children []*NodeBPlus
+	Leaf     bool
+	Next     *NodeBPlus `json:"-"`
+	Prev     *NodeBPlus `json:"-"`
+}
+
+type BPlusTree struct {
+	Root  *NodeBPlus
+	Order int
+}
+
+func NewBPlusTree() *BPlusTree {
+	return NewBPlusTreeOrder(defaultBTreeOrder)
+}
+
+func NewBPlusTreeOrder(order int) *BPlusTree {
+	if order < 2 {
+		order = defaultBTreeOrder
+	}
+	return &BPlusTree{
+		Root:  &NodeBPlus{Leaf: true},
+		Order: order,
+	}
+}
+
+func (t *BPlusTree) maxKeys() int {
+	return 2*t.Order - 1
+}
+
+func (t *BPlusTree) minKeys() int {
+	return t.Order - 1
+}
+
+func childIndexBPlus(node *NodeBPlus, key string) int {
+	i := 0
+	for i < len(node.Keys) && key >= node.Keys[i] {
+		i++
+	}
+	return i
+}
+
+func leafIndexBPlus(leaf *NodeBPlus, key string) (int, bool) {
+	i := 0
+	for i < len(leaf.Keys) && leaf.Keys[i] < key {
+		i++
+	}
+	return i, i < len(leaf.Keys) && leaf.Keys[i] == key
+}
+
+func (t *BPlusTree) findLeaf(key string) *NodeBPlus {
+	node := t.Root
+	for !node.Leaf {
+		node = node.Children[childIndexBPlus(node, key)]
+	}
+	return node
+}
+
+func (t *BPlusTree) firstLeaf() *NodeBPlus {
+	node := t.Root
+	for !node.Leaf {
+		node = node.Children[0]
+	}
+	return node
+}
+
+func (t *BPlusTree) Insert(key string, value interface{}) error {
+	splitKey, right, err := t.insert(t.Root, key, value)
+	if err != nil {
+		return err
+	}
+	if right != nil {
+		t.Root = &NodeBPlus{
+			Keys:     []string{splitKey},
+			Children: []*NodeBPlus{t.Root, right},
+		}
+	}
+	return nil
+}
+
+// insert returns the separator and new right sibling when node had to split.
+func (t *BPlusTree) insert(node *NodeBPlus, key string, value interface{}) (string, *NodeBPlus, error) {
+	if node.Leaf {
+		i, found := leafIndexBPlus(node, key)
+		if found {
+			return "", nil, ErrKeyExists
+		}
+		node.Keys = append(node.Keys[:i], append([]string{key}, node.Keys[i:]...)...)
+		node.Values = append(node.Values[:i], append([]interface{}{value}, node.Values[i:]...)...)
+		if len(node.Keys) <= t.maxKeys() {
+			return "", nil, nil
+		}
+
+		mid := len(node.Keys) / 2
+		right := &NodeBPlus{
+			Keys:   append([]string{}, node.Keys[mid:]...),
+			Values: append([]interface{}{}, node.Values[mid:]...),
+			Leaf:   true,
+			Next:   node.Next,
+			Prev:   node,
+		}
+		if node.Next != nil {
+			node.Next.Prev = right
+		}
+		node.Next = right
+		node.Keys = node.Keys[:mid]
+		node.Values = node.Values[:mid]
+		return right.Keys[0], right, nil
+	}
+
+	i := childIndexBPlus(node, key)
+	splitKey, right, err := t.insert(node.Children[i], key, value)
+	if err != nil || right == nil {
+		return "", nil, err
+	}
+	node.Keys = append(node.Keys[:i], append([]string{splitKey}, node.Keys[i:]...)...)
+	node.Children = append(node.Children[:i+1], append([]*NodeBPlus{right}, node.Children[i+1:]...)...)
+	if len(node.Keys) <= t.maxKeys() {
+		return "", nil, nil
+	}
+
+	mid := len(node.Keys) / 2
+	promoted := node.Keys[mid]
+	newNode := &NodeBPlus{
+		Keys:     append([]string{}, node.Keys[mid+1:]...),
+		Children: append([]*NodeBPlus{}, node.Children[mid+1:]...),
+	}
+	node.Keys = node.Keys[:mid]
+	node.Children = node.Children[:mid+1]
+	return promoted, newNode, nil
+}
+
+func (t *BPlusTree) Get(key string) (interface{}, error) {
+	leaf := t.findLeaf(key)
+	i, found := leafIndexBPlus(leaf, key)
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return leaf.Values[i], nil
+}
+
+// GetRange descends once to the leaf holding minValue and then follows the
+// leaf links until the keys pass maxValue.
+func (t *BPlusTree) GetRange(minValue, maxValue string) ([]string, error) {
+	result := make([]string, 0)
+	leaf := t.findLeaf(minValue)
+	i, _ := leafIndexBPlus(leaf, minValue)
+	for leaf != nil {
+		for ; i < len(leaf.Keys); i++ {
+			if leaf.Keys[i] > maxValue {
+				return result, nil
+			}
+			result = append(result, leaf.Keys[i])
+		}
+		leaf = leaf.Next
+		i = 0
+	}
+	return result, nil
+}
+
+func (t *BPlusTree) lastLeaf() *NodeBPlus {
+	node := t.Root
+	for !node.Leaf {
+		node = node.Children[len(node.Children)-1]
+	}
+	return node
+}
+
+func (t *BPlusTree) Range(query RangeQuery) ([]KeyValue, error) {
+	collector := newRangeCollector(query)
+	if query.Descending {
+		leaf := t.lastLeaf()
+		if query.HasMax {
+			leaf = t.findLeaf(query.Max)
+		}
+		for ; leaf != nil; leaf = leaf.Prev {
+			for i := len(leaf.Keys) - 1; i >= 0; i-- {
+				key := leaf.Keys[i]
+				if query.aboveMax(key) {
+					continue
+				}
+				if query.belowMin(key) || !collector.add(key, leaf.Values[i]) {
+					return collector.result, nil
+				}
+			}
+		}
+		return collector.result, nil
+	}
+
+	leaf := t.firstLeaf()
+	if query.HasMin {
+		leaf = t.findLeaf(query.Min)
+	}
+	for ; leaf != nil; leaf = leaf.Next {
+		for i, key := range leaf.Keys {
+			if query.belowMin(key) {
+				continue
+			}
+			if query.aboveMax(key) || !collector.add(key, leaf.Values[i]) {
+				return collector.result, nil
+			}
+		}
+	}
+	return collector.result, nil
+}
+
+// bPlusTreeIterator only needs the current leaf: leaves are linked both ways.
+type bPlusTreeIterator struct {
+	tree  *BPlusTree
+	leaf  *NodeBPlus
+	index int
+}
+
+func (t *BPlusTree) NewIterator() Iterator {
+	return &bPlusTreeIterator{tree: t}
+}
+
+func (it *bPlusTreeIterator) Seek(key string) bool {
+	it.leaf = it.tree.findLeaf(key)
+	it.index, _ = leafIndexBPlus(it.leaf, key)
+	if it.index < len(it.leaf.Keys) {
+		return true
+	}
+	it.index--
+	return it.Next()
+}
+
+func (it *bPlusTreeIterator) Next() bool {
+	if it.leaf == nil {
+		it.leaf, it.index = it.tree.firstLeaf(), -1
+	}
+	it.index++
+	for it.leaf != nil && it.index >= len(it.leaf.Keys) {
+		it.leaf, it.index = it.leaf.Next, 0
+	}
+	return it.leaf != nil
+}
+
+func (it *bPlusTreeIterator) Prev() bool {
+	if it.leaf == nil {
+		it.leaf = it.tree.lastLeaf()
+		it.index = len(it.leaf.Keys)
+	}
+	it.index--
+	for it.leaf != nil && it.index < 0 {
+		it.leaf = it.leaf.Prev
+		if it.leaf != nil {
+			it.index = len(it.leaf.Keys) - 1
+		}
+	}
+	return it.leaf != nil
+}
+
+func (it *bPlusTreeIterator) Key() string {
+	return it.leaf.Keys[it.index]
+}
+
+func (it *bPlusTreeIterator) Value() interface{} {
+	return it.leaf.Values[it.index]
+}
+
+func (it *bPlusTreeIterator) Close() {
+	it.leaf = nil
+}
+
+func (t *BPlusTree) Count(minValue, maxValue string) (int, error) {
+	return countByScan(t, minValue, maxValue)
+}
+
+func (t *BPlusTree) Rank(key string) (int, error) {
+	return rankByScan(t, key)
+}
+
+func (t *BPlusTree) Select(position int) (KeyValue, error) {
+	return selectByScan(t, position)
+}
+
+// Validate checks key order and separators, key counts against Order, a
+// single leaf depth and that the leaf chain links every leaf in order.
+func (t *BPlusTree) Validate() error {
+	leafDepth := -1
+	leaves := make([]*NodeBPlus, 0)
+	paths := make([]string, 0)
+
+	var validate func(node *NodeBPlus, path string, depth int, low, high *string) error
+	validate = func(node *NodeBPlus, path string, depth int, low, high *string) error {
+		if len(node.Keys) > t.maxKeys() || node != t.Root && len(node.Keys) < t.minKeys() {
+			return corruptedAt(path, "%d ключей при порядке %d", len(node.Keys), t.Order)
+		}
+		for i, key := range node.Keys {
+			if i > 0 && key <= node.Keys[i-1] || low != nil && key < *low || high != nil && key >= *high {
+				return corruptedAt(path, "ключ %s нарушает порядок", key)
+			}
+		}
+
+		if node.Leaf {
+			if len(node.Values) != len(node.Keys) {
+				return corruptedAt(path, "%d ключей, но %d значений", len(node.Keys), len(node.Values))
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return corruptedAt(path, "лист на глубине %d, остальные на %d", depth, leafDepth)
+			}
+			leaves = append(leaves, node)
+			paths = append(paths, path)
+			return nil
+		}
+		if len(node.Children) != len(node.Keys)+1 {
+			return corruptedAt(path, "%d ключей, но %d потомков", len(node.Keys), len(node.Children))
+		}
+		for i, child := range node.Children {
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = &node.Keys[i-1]
+			}
+			if i < len(node.Keys) {
+				childHigh = &node.Keys[i]
+			}
+			if err := validate(child, fmt.Sprintf("%s.%d", path, i), depth+1, childLow, childHigh); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := validate(t.Root, "root", 0, nil, nil); err != nil {
+		return err
+	}
+
+	for i, leaf := range leaves {
+		var prev, next *NodeBPlus
+		if i > 0 {
+			prev = leaves[i-1]
+		}
+		if i < len(leaves)-1 {
+			next = leaves[i+1]
+		}
+		if leaf.Prev != prev || leaf.Next != next {
+			return corruptedAt(paths[i], "лист неверно связан с соседями")
+		}
+	}
+	return nil
+}
+
+func (t *BPlusTree) Update(key string, value interface{}) error {
+	leaf := t.findLeaf(key)
+	i, found := leafIndexBPlus(leaf, key)
+	if !found {
+		return ErrKeyNotFound
+	}
+	leaf.Values[i] = value
+	return nil
+}
+
+func (t *BPlusTree) Remove(key string) error {
+	if err := t.remove(t.Root, key); err != nil {
+		return err
+	}
+	if !t.Root.Leaf && len(t.Root.Keys) == 0 {
+		t.Root = t.Root.Children[0]
+	}
+	return nil
+}
+
+func (t *BPlusTree) remove(node *NodeBPlus, key string) error {
+	if node.Leaf {
+		i, found := leafIndexBPlus(node, key)
+		if !found {
+			return ErrKeyNotFound
+		}
+		node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
+		node.Values = append(node.Values[:i], node.Values[i+1:]...)
+		return nil
+	}
+
+	i := childIndexBPlus(node, key)
+	if err := t.remove(node.Children[i], key); err != nil {
+		return err
+	}
+	if len(node.Children[i].Keys) < t.minKeys() {
+		t.rebalance(node, i)
+	}
+	return nil
+}
+
+// rebalance fixes an underfull child i by borrowing from a sibling that can
+// spare a key, or by merging it with a sibling.
+func (t *BPlusTree) rebalance(parent *NodeBPlus, i int) {
+	child := parent.Children[i]
+	if i > 0 && len(parent.Children[i-1].Keys) > t.minKeys() {
+		left := parent.Children[i-1]
+		if child.Leaf {
+			last := len(left.Keys) - 1
+			child.Keys = append([]string{left.Keys[last]}, child.Keys...)
+			child.Values = append([]interface{}{left.Values[last]}, child.Values...)
+			left.Keys = left.Keys[:last]
+			left.Values = left.Values[:last]
+			parent.Keys[i-1] = child.Keys[0]
+		} else {
+			last := len(left.Keys) - 1
+			child.Keys = append([]string{parent.Keys[i-1]}, child.Keys...)
+			child.Children = append([]*NodeBPlus{left.Children[last+1]}, child.Children...)
+			parent.Keys[i-1] = left.Keys[last]
+			left.Keys = left.Keys[:last]
+			left.Children = left.Children[:last+1]
+		}
+		return
+	}
+	if i < len(parent.Children)-1 && len(parent.Children[i+1].Keys) > t.minKeys() {
+		right := parent.Children[i+1]
+		if child.Leaf {
+			child.Keys = append(child.Keys, right.Keys[0])
+			child.Values = append(child.Values, right.Values[0])
+			right.Keys = right.Keys[1:]
+			right.Values = right.Values[1:]
+			parent.Keys[i] = right.Keys[0]
+		} else {
+			child.Keys = append(child.Keys, parent.Keys[i])
+			child.Children = append(child.Children, right.Children[0])
+			parent.Keys[i] = right.Keys[0]
+			right.Keys = right.Keys[1:]
+			right.Children = right.Children[1:]
+		}
+		return
+	}
+	if i > 0 {
+		t.mergeChildren(parent, i-1)
+	} else {
+		t.mergeChildren(parent, i)
+	}
+}
+
+func (t *BPlusTree) mergeChildren(parent *NodeBPlus, i int) {
+	left := parent.Children[i]
+	right := parent.Children[i+1]
+	if left.Leaf {
+		left.Keys = append(left.Keys, right.Keys...)
+		left.Values = append(left.Values, right.Values...)
+		left.Next = right.Next
+		if right.Next != nil {
+			right.Next.Prev = left
+		}
+	} else {
+		left.Keys = append(append(left.Keys, parent.Keys[i]), right.Keys...)
+		left.Children = append(left.Children, right.Children...)
+	}
+	parent.Keys = append(parent.Keys[:i], parent.Keys[i+1:]...)
+	parent.Children = append(parent.Children[:i+1], parent.Children[i+2:]...)
+}
+
+func (t *BPlusTree) Walk(fn func(key string, value interface{})) {
+	for leaf := t.firstLeaf(); leaf != nil; leaf = leaf.Next {
+		for i, key := range leaf.Keys {
+			fn(key, leaf.Values[i])
+		}
+	}
+}
+
+// BulkLoad replaces the tree with pairs, which must be sorted by key without
+// duplicates. Leaves are packed as full as the order allows and every level
+// above is built directly from the one below.
+func (t *BPlusTree) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		t.Root = &NodeBPlus{Leaf: true}
+		return nil
+	}
+
+	var level []*NodeBPlus
+	var lowKeys []string
+	var prev *NodeBPlus
+	for _, part := range splitEvenly(len(pairs), t.maxKeys()) {
+		leaf := &NodeBPlus{Leaf: true, Prev: prev}
+		for _, pair := range pairs[part[0]:part[1]] {
+			leaf.Keys = append(leaf.Keys, pair.Key)
+			leaf.Values = append(leaf.Values, pair.Value)
+		}
+		if prev != nil {
+			prev.Next = leaf
+		}
+		prev = leaf
+		level = append(level, leaf)
+		lowKeys = append(lowKeys, leaf.Keys[0])
+	}
+
+	for len(level) > 1 {
+		var parents []*NodeBPlus
+		var parentLowKeys []string
+		for _, part := range splitEvenly(len(level), t.maxKeys()+1) {
+			parent := &NodeBPlus{Children: append([]*NodeBPlus{}, level[part[0]:part[1]]...)}
+			parent.Keys = append([]string{}, lowKeys[part[0]+1:part[1]]...)
+			parents = append(parents, parent)
+			parentLowKeys = append(parentLowKeys, lowKeys[part[0]])
+		}
+		level = parents
+		lowKeys = parentLowKeys
+	}
+	t.Root = level[0]
+	return nil
+}
+
+// splitEvenly cuts n items into the fewest groups of at most capacity items,
+// as equal in size as possible, and returns their [start, end) bounds.
+func splitEvenly(n, capacity int) [][2]int {
+	groups := (n + capacity - 1) / capacity
+	bounds := make([][2]int, 0, groups)
+	start := 0
+	for g := 0; g < groups; g++ {
+		size := n / groups
+		if g < n%groups {
+			size++
+		}
+		bounds = append(bounds, [2]int{start, start + size})
+		start += size
+	}
+	return bounds
+}
+
+func (t *BPlusTree) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "bplustree", Order: t.Order}, t)
+}
+
+func (t *BPlusTree) LoadFromFile(filename string) error {
+	return loadTreeFileInto(filename, t)
+}
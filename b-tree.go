@@ -1,43 +1,55 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 )
 
-const m = 2
+const defaultBTreeOrder = 2
 
+// NodeB holds Values[i] for Keys[i]. Order is the minimum degree: every node
+// except the root keeps between Order-1 and 2*Order-1 keys.
 type NodeB struct {
 	Keys     []string
+	Values   []interface{}
 	Children []*NodeB
 	Leaf     bool
-	Value    interface{}
 }
 
 type BTree struct {
-	Root *NodeB
+	Root  *NodeB
+	Order int
 }
 
-func NewNodeB(leaf bool, value interface{}) *NodeB {
+func NewNodeB(leaf bool) *NodeB {
 	return &NodeB{
 		Keys:     make([]string, 0),
+		Values:   make([]interface{}, 0),
 		Children: make([]*NodeB, 0),
 		Leaf:     leaf,
-		Value:    value,
 	}
 }
 
 func NewBTree() *BTree {
+	return NewBTreeOrder(defaultBTreeOrder)
+}
+
+func NewBTreeOrder(order int) *BTree {
+	if order < 2 {
+		order = defaultBTreeOrder
+	}
 	return &BTree{
-		Root: NewNodeB(true, nil),
+		Root:  NewNodeB(true),
+		Order: order,
 	}
 }
 
 func (t *BTree) Insert(key string, value interface{}) error {
+	if t.Search(key) != nil {
+		return ErrKeyExists
+	}
 	root := t.Root
-	if len(root.Keys) == (2*m - 1) {
-		newRoot := NewNodeB(false, nil)
+	if len(root.Keys) == (2*t.Order - 1) {
+		newRoot := NewNodeB(false)
 		newRoot.Children = append(newRoot.Children, root)
 		t.Root = newRoot
 		t.splitChild(newRoot, 0)
@@ -50,15 +62,19 @@ func (t *BTree) Insert(key string, value interface{}) error {
 
 func (t *BTree) splitChild(node *NodeB, i int) {
 	child := node.Children[i]
-	newChild := NewNodeB(child.Leaf, nil)
+	newChild := NewNodeB(child.Leaf)
 	mid := len(child.Keys) / 2
 	splitKey := child.Keys[mid]
+	splitValue := child.Values[mid]
 
 	node.Children = append(node.Children[:i+1], append([]*NodeB{newChild}, node.Children[i+1:]...)...)
 	node.Keys = append(node.Keys[:i], append([]string{splitKey}, node.Keys[i:]...)...)
+	node.Values = append(node.Values[:i], append([]interface{}{splitValue}, node.Values[i:]...)...)
 
 	newChild.Keys = append(newChild.Keys, child.Keys[mid+1:]...)
+	newChild.Values = append(newChild.Values, child.Values[mid+1:]...)
 	child.Keys = child.Keys[:mid]
+	child.Values = child.Values[:mid]
 
 	if !child.Leaf {
 		newChild.Children = append(newChild.Children, child.Children[mid+1:]...)
@@ -73,13 +89,13 @@ func (t *BTree) insertNonFull(node *NodeB, key string, value interface{}) {
 			i--
 		}
 		node.Keys = append(node.Keys[:i+1], append([]string{key}, node.Keys[i+1:]...)...)
-		node.Value = value
+		node.Values = append(node.Values[:i+1], append([]interface{}{value}, node.Values[i+1:]...)...)
 	} else {
 		for i >= 0 && key < node.Keys[i] {
 			i--
 		}
 		i++
-		if len(node.Children[i].Keys) == (2*m - 1) {
+		if len(node.Children[i].Keys) == (2*t.Order - 1) {
 			t.splitChild(node, i)
 			if key > node.Keys[i] {
 				i++
@@ -90,27 +106,31 @@ func (t *BTree) insertNonFull(node *NodeB, key string, value interface{}) {
 }
 
 func (t *BTree) Search(key string) *NodeB {
-	return t.search(t.Root, key)
+	node, _ := t.search(t.Root, key)
+	return node
 }
 
-func (t *BTree) search(node *NodeB, key string) *NodeB {
+func (t *BTree) search(node *NodeB, key string) (*NodeB, int) {
 	if node == nil {
-		return nil
+		return nil, -1
 	}
 	i := 0
 	for i < len(node.Keys) && key > node.Keys[i] {
 		i++
 	}
 	if i < len(node.Keys) && key == node.Keys[i] {
-		return node
+		return node, i
 	}
 	if node.Leaf {
-		return nil
+		return nil, -1
 	}
 	return t.search(node.Children[i], key)
 }
 
 func (t *BTree) Remove(key string) error {
+	if t.Search(key) == nil {
+		return ErrKeyNotFound
+	}
 	t.Root = t.delete(t.Root, key)
 	if len(t.Root.Keys) == 0 && len(t.Root.Children) == 1 {
 		t.Root = t.Root.Children[0]
@@ -135,7 +155,7 @@ func (t *BTree) delete(node *NodeB, key string) *NodeB {
 			return node
 		}
 		flag := (i == len(node.Keys))
-		if len(node.Children[i].Keys) < m {
+		if len(node.Children[i].Keys) < t.Order {
 			t.fill(node, i)
 		}
 		if flag && i > len(node.Keys) {
@@ -150,44 +170,48 @@ func (t *BTree) delete(node *NodeB, key string) *NodeB {
 func (t *BTree) removeFromLeaf(node *NodeB, idx int) {
 	copy(node.Keys[idx:], node.Keys[idx+1:])
 	node.Keys = node.Keys[:len(node.Keys)-1]
+	copy(node.Values[idx:], node.Values[idx+1:])
+	node.Values = node.Values[:len(node.Values)-1]
 }
 
 func (t *BTree) removeFromNonLeaf(node *NodeB, idx int) {
 	key := node.Keys[idx]
-	if len(node.Children[idx].Keys) >= m {
-		pred := t.getPred(node, idx)
-		node.Keys[idx] = pred
-		t.delete(node.Children[idx], pred)
-	} else if len(node.Children[idx+1].Keys) >= m {
-		succ := t.getSucc(node, idx)
-		node.Keys[idx] = succ
-		t.delete(node.Children[idx+1], succ)
+	if len(node.Children[idx].Keys) >= t.Order {
+		predKey, predValue := t.getPred(node, idx)
+		node.Keys[idx] = predKey
+		node.Values[idx] = predValue
+		node.Children[idx] = t.delete(node.Children[idx], predKey)
+	} else if len(node.Children[idx+1].Keys) >= t.Order {
+		succKey, succValue := t.getSucc(node, idx)
+		node.Keys[idx] = succKey
+		node.Values[idx] = succValue
+		node.Children[idx+1] = t.delete(node.Children[idx+1], succKey)
 	} else {
 		t.merge(node, idx)
-		t.delete(node.Children[idx], key)
+		node.Children[idx] = t.delete(node.Children[idx], key)
 	}
 }
 
-func (t *BTree) getPred(node *NodeB, idx int) string {
+func (t *BTree) getPred(node *NodeB, idx int) (string, interface{}) {
 	cur := node.Children[idx]
 	for !cur.Leaf {
 		cur = cur.Children[len(cur.Children)-1]
 	}
-	return cur.Keys[len(cur.Keys)-1]
+	return cur.Keys[len(cur.Keys)-1], cur.Values[len(cur.Values)-1]
 }
 
-func (t *BTree) getSucc(node *NodeB, idx int) string {
+func (t *BTree) getSucc(node *NodeB, idx int) (string, interface{}) {
 	cur := node.Children[idx+1]
 	for !cur.Leaf {
 		cur = cur.Children[0]
 	}
-	return cur.Keys[0]
+	return cur.Keys[0], cur.Values[0]
 }
 
 func (t *BTree) fill(node *NodeB, idx int) {
-	if idx != 0 && len(node.Children[idx-1].Keys) >= m {
+	if idx != 0 && len(node.Children[idx-1].Keys) >= t.Order {
 		t.borrowFromPrev(node, idx)
-	} else if idx != len(node.Keys) && len(node.Children[idx+1].Keys) >= m {
+	} else if idx != len(node.Keys) && len(node.Children[idx+1].Keys) >= t.Order {
 		t.borrowFromNext(node, idx)
 	} else {
 		if idx != len(node.Keys) {
@@ -203,12 +227,15 @@ func (t *BTree) borrowFromPrev(node *NodeB, idx int) {
 	sibling := node.Children[idx-1]
 
 	child.Keys = append([]string{node.Keys[idx-1]}, child.Keys...)
+	child.Values = append([]interface{}{node.Values[idx-1]}, child.Values...)
 
 	if !child.Leaf {
 		child.Children = append([]*NodeB{sibling.Children[len(sibling.Children)-1]}, child.Children...)
 	}
 	node.Keys[idx-1] = sibling.Keys[len(sibling.Keys)-1]
+	node.Values[idx-1] = sibling.Values[len(sibling.Values)-1]
 	sibling.Keys = sibling.Keys[:len(sibling.Keys)-1]
+	sibling.Values = sibling.Values[:len(sibling.Values)-1]
 	if !sibling.Leaf {
 		sibling.Children = sibling.Children[:len(sibling.Children)-1]
 	}
@@ -219,12 +246,15 @@ func (t *BTree) borrowFromNext(node *NodeB, idx int) {
 	sibling := node.Children[idx+1]
 
 	child.Keys = append(child.Keys, node.Keys[idx])
+	child.Values = append(child.Values, node.Values[idx])
 
 	if !child.Leaf {
 		child.Children = append(child.Children, sibling.Children[0])
 	}
 	node.Keys[idx] = sibling.Keys[0]
+	node.Values[idx] = sibling.Values[0]
 	sibling.Keys = sibling.Keys[1:]
+	sibling.Values = sibling.Values[1:]
 	if !sibling.Leaf {
 		sibling.Children = sibling.Children[1:]
 	}
@@ -236,20 +266,23 @@ func (t *BTree) merge(node *NodeB, idx int) {
 
 	child.Keys = append(child.Keys, node.Keys[idx])
 	child.Keys = append(child.Keys, sibling.Keys...)
+	child.Values = append(child.Values, node.Values[idx])
+	child.Values = append(child.Values, sibling.Values...)
 	if !child.Leaf {
 		child.Children = append(child.Children, sibling.Children...)
 	}
 
 	node.Keys = append(node.Keys[:idx], node.Keys[idx+1:]...)
+	node.Values = append(node.Values[:idx], node.Values[idx+1:]...)
 	node.Children = append(node.Children[:idx+1], node.Children[idx+2:]...)
 }
 
 func (t *BTree) Get(key string) (interface{}, error) {
-	node := t.Search(key)
+	node, i := t.search(t.Root, key)
 	if node == nil {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
 	}
-	return node.Value, nil
+	return node.Values[i], nil
 }
 
 func (t *BTree) GetRange(minValue, maxValue string) ([]string, error) {
@@ -269,45 +302,368 @@ func (t *BTree) traverseRange(node *NodeB, minValue, maxValue string, keysInRang
 	}
 
 	for ; i < len(node.Keys); i++ {
-		if node.Children[i] != nil {
+		if !node.Leaf {
 			t.traverseRange(node.Children[i], minValue, maxValue, keysInRange)
 		}
-		if node.Keys[i] >= minValue && node.Keys[i] <= maxValue {
-			*keysInRange = append(*keysInRange, node.Keys[i])
-		}
 		if node.Keys[i] > maxValue {
-			break
+			return
 		}
+		*keysInRange = append(*keysInRange, node.Keys[i])
 	}
 
-	if node.Children[i] != nil {
+	if !node.Leaf {
 		t.traverseRange(node.Children[i], minValue, maxValue, keysInRange)
 	}
 }
 
+func (t *BTree) Range(query RangeQuery) ([]KeyValue, error) {
+	collector := newRangeCollector(query)
+	t.rangeNode(t.Root, query, collector)
+	return collector.result, nil
+}
+
+// rangeNode visits node in scan order and returns false once the scan is over.
+func (t *BTree) rangeNode(node *NodeB, query RangeQuery, collector *rangeCollector) bool {
+	n := len(node.Keys)
+	for j := 0; j < n; j++ {
+		i := j
+		if query.Descending {
+			i = n - 1 - j
+		}
+		key := node.Keys[i]
+		var child *NodeB
+		visitChild := false
+		if !node.Leaf {
+			if query.Descending {
+				child, visitChild = node.Children[i+1], query.hasGreater(key)
+			} else {
+				child, visitChild = node.Children[i], query.hasLess(key)
+			}
+		}
+		if visitChild && !t.rangeNode(child, query, collector) {
+			return false
+		}
+		if query.Contains(key) && !collector.add(key, node.Values[i]) {
+			return false
+		}
+		if query.Descending && !query.hasLess(key) || !query.Descending && !query.hasGreater(key) {
+			return false
+		}
+	}
+	if node.Leaf {
+		return true
+	}
+	if query.Descending {
+		return t.rangeNode(node.Children[0], query, collector)
+	}
+	return t.rangeNode(node.Children[n], query, collector)
+}
+
+// bTreeFrame is one step of a BTree iterator path. In the last frame Index is
+// the current key; in the frames above it, the child that was descended into.
+type bTreeFrame struct {
+	Node  *NodeB
+	Index int
+}
+
+type bTreeIterator struct {
+	tree *BTree
+	path []bTreeFrame
+}
+
+func (t *BTree) NewIterator() Iterator {
+	return &bTreeIterator{tree: t}
+}
+
+func (it *bTreeIterator) top() *bTreeFrame {
+	return &it.path[len(it.path)-1]
+}
+
+func (it *bTreeIterator) Seek(key string) bool {
+	it.path = it.path[:0]
+	node := it.tree.Root
+	for {
+		i := 0
+		for i < len(node.Keys) && node.Keys[i] < key {
+			i++
+		}
+		if i < len(node.Keys) && node.Keys[i] == key {
+			it.path = append(it.path, bTreeFrame{node, i})
+			return true
+		}
+		if node.Leaf {
+			if i < len(node.Keys) {
+				it.path = append(it.path, bTreeFrame{node, i})
+				return true
+			}
+			if i == 0 {
+				it.path = it.path[:0]
+				return false
+			}
+			// Every key of this leaf is smaller: continue from its last one.
+			it.path = append(it.path, bTreeFrame{node, i - 1})
+			return it.Next()
+		}
+		it.path = append(it.path, bTreeFrame{node, i})
+		node = node.Children[i]
+	}
+}
+
+// descend goes down from node to its first (or last) key.
+func (it *bTreeIterator) descend(node *NodeB, first bool) bool {
+	for !node.Leaf {
+		i := 0
+		if !first {
+			i = len(node.Children) - 1
+		}
+		it.path = append(it.path, bTreeFrame{node, i})
+		node = node.Children[i]
+	}
+	if len(node.Keys) == 0 {
+		it.path = it.path[:0]
+		return false
+	}
+	i := 0
+	if !first {
+		i = len(node.Keys) - 1
+	}
+	it.path = append(it.path, bTreeFrame{node, i})
+	return true
+}
+
+func (it *bTreeIterator) Next() bool {
+	if len(it.path) == 0 {
+		return it.descend(it.tree.Root, true)
+	}
+	frame := it.top()
+	if !frame.Node.Leaf {
+		frame.Index++
+		return it.descend(frame.Node.Children[frame.Index], true)
+	}
+	if frame.Index+1 < len(frame.Node.Keys) {
+		frame.Index++
+		return true
+	}
+	for {
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) == 0 {
+			return false
+		}
+		if frame := it.top(); frame.Index < len(frame.Node.Keys) {
+			return true
+		}
+	}
+}
+
+func (it *bTreeIterator) Prev() bool {
+	if len(it.path) == 0 {
+		return it.descend(it.tree.Root, false)
+	}
+	frame := it.top()
+	if !frame.Node.Leaf {
+		return it.descend(frame.Node.Children[frame.Index], false)
+	}
+	if frame.Index > 0 {
+		frame.Index--
+		return true
+	}
+	for {
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) == 0 {
+			return false
+		}
+		if frame := it.top(); frame.Index > 0 {
+			frame.Index--
+			return true
+		}
+	}
+}
+
+func (it *bTreeIterator) Key() string {
+	frame := it.top()
+	return frame.Node.Keys[frame.Index]
+}
+
+func (it *bTreeIterator) Value() interface{} {
+	frame := it.top()
+	return frame.Node.Values[frame.Index]
+}
+
+func (it *bTreeIterator) Close() {
+	it.path = nil
+}
+
+func (t *BTree) Count(minValue, maxValue string) (int, error) {
+	return countByScan(t, minValue, maxValue)
+}
+
+func (t *BTree) Rank(key string) (int, error) {
+	return rankByScan(t, key)
+}
+
+func (t *BTree) Select(position int) (KeyValue, error) {
+	return selectByScan(t, position)
+}
+
+// capacity is the most keys a subtree of the given height can hold, with
+// every node full: (2*Order)^(height+1) - 1.
+func (t *BTree) capacity(height int) int {
+	keys := 2*t.Order - 1
+	for ; height > 0; height-- {
+		keys = (keys+1)*2*t.Order - 1
+	}
+	return keys
+}
+
+// BulkLoad replaces the tree with one built from sorted pairs in O(n). It
+// takes the lowest height that fits the pairs and, at every node, the fewest
+// children that can hold them, so nodes come out as full as the order allows.
+func (t *BTree) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
+		return err
+	}
+	height := 0
+	for t.capacity(height) < len(pairs) {
+		height++
+	}
+	t.Root = t.buildNode(pairs, height, true)
+	return nil
+}
+
+func (t *BTree) buildNode(pairs []KeyValue, height int, root bool) *NodeB {
+	node := NewNodeB(height == 0)
+	if height == 0 {
+		for _, pair := range pairs {
+			node.Keys = append(node.Keys, pair.Key)
+			node.Values = append(node.Values, pair.Value)
+		}
+		return node
+	}
+
+	// The fewest children whose subtrees, filled up, leave room for the
+	// separators between them; a non-root node needs at least Order.
+	children := (len(pairs) + 1 + t.capacity(height-1)) / (t.capacity(height-1) + 1)
+	if !root && children < t.Order {
+		children = t.Order
+	}
+	perChild, extra := (len(pairs)-children+1)/children, (len(pairs)-children+1)%children
+	start := 0
+	for i := 0; i < children; i++ {
+		end := start + perChild
+		if i < extra {
+			end++
+		}
+		node.Children = append(node.Children, t.buildNode(pairs[start:end], height-1, false))
+		if i < children-1 {
+			node.Keys = append(node.Keys, pairs[end].Key)
+			node.Values = append(node.Values, pairs[end].Value)
+		}
+		start = end + 1
+	}
+	return node
+}
+
+// Validate checks key order, key counts against Order, child counts, a
+// single leaf depth and that no two nodes share the memory of their Keys or
+// Values, which would let a write to one node show up in another.
+func (t *BTree) Validate() error {
+	leafDepth := -1
+	keyOwners := make(map[*string]string)
+	valueOwners := make(map[*interface{}]string)
+
+	var validate func(node *NodeB, path string, depth int, low, high *string) error
+	validate = func(node *NodeB, path string, depth int, low, high *string) error {
+		if len(node.Values) != len(node.Keys) {
+			return corruptedAt(path, "%d ключей, но %d значений", len(node.Keys), len(node.Values))
+		}
+		if len(node.Keys) > 2*t.Order-1 || node != t.Root && len(node.Keys) < t.Order-1 {
+			return corruptedAt(path, "%d ключей при порядке %d", len(node.Keys), t.Order)
+		}
+		if cap(node.Keys) > 0 {
+			end := &node.Keys[:cap(node.Keys)][cap(node.Keys)-1]
+			if owner, ok := keyOwners[end]; ok {
+				return corruptedAt(path, "ключи делят память с узлом %s", owner)
+			}
+			keyOwners[end] = path
+		}
+		if cap(node.Values) > 0 {
+			end := &node.Values[:cap(node.Values)][cap(node.Values)-1]
+			if owner, ok := valueOwners[end]; ok {
+				return corruptedAt(path, "значения делят память с узлом %s", owner)
+			}
+			valueOwners[end] = path
+		}
+		for i, key := range node.Keys {
+			if i > 0 && key <= node.Keys[i-1] || low != nil && key <= *low || high != nil && key >= *high {
+				return corruptedAt(path, "ключ %s нарушает порядок", key)
+			}
+		}
+
+		if node.Leaf {
+			if len(node.Children) != 0 {
+				return corruptedAt(path, "у листа %d потомков", len(node.Children))
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return corruptedAt(path, "лист на глубине %d, остальные на %d", depth, leafDepth)
+			}
+			return nil
+		}
+		if len(node.Children) != len(node.Keys)+1 {
+			return corruptedAt(path, "%d ключей, но %d потомков", len(node.Keys), len(node.Children))
+		}
+		for i, child := range node.Children {
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = &node.Keys[i-1]
+			}
+			if i < len(node.Keys) {
+				childHigh = &node.Keys[i]
+			}
+			if err := validate(child, fmt.Sprintf("%s.%d", path, i), depth+1, childLow, childHigh); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return validate(t.Root, "root", 0, nil, nil)
+}
+
 func (t *BTree) Update(key string, value interface{}) error {
-	node := t.Search(key)
+	node, i := t.search(t.Root, key)
 	if node == nil {
-		return fmt.Errorf("key not found")
+		return ErrKeyNotFound
 	}
-	node.Value = value
+	node.Values[i] = value
 	return nil
 }
 
-func (t *BTree) SaveToFile(filename string) error {
-	data, err := json.Marshal(t)
-	if err != nil {
-		return err
+func (t *BTree) Walk(fn func(key string, value interface{})) {
+	t.walk(t.Root, fn)
+}
+
+func (t *BTree) walk(node *NodeB, fn func(key string, value interface{})) {
+	if node == nil {
+		return
+	}
+	for i, key := range node.Keys {
+		if !node.Leaf {
+			t.walk(node.Children[i], fn)
+		}
+		fn(key, node.Values[i])
+	}
+	if !node.Leaf {
+		t.walk(node.Children[len(node.Keys)], fn)
 	}
-	return os.WriteFile(filename, data, 0644)
+}
+
+func (t *BTree) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "btree", Order: t.Order}, t)
 }
 
 func (t *BTree) LoadFromFile(filename string) error {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, t)
+	return loadTreeFileInto(filename, t)
 }
 
 type BTreeCollection struct {
@@ -341,17 +697,9 @@ func (bc *BTreeCollection) Remove(key string) error {
 }
 
 func (bc *BTreeCollection) SaveToFile(filename string) error {
-	data, err := json.Marshal(bc)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(filename, data, 0644)
+	return bc.Tree.SaveToFile(filename)
 }
 
 func (bc *BTreeCollection) LoadFromFile(filename string) error {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, bc)
+	return bc.Tree.LoadFromFile(filename)
 }
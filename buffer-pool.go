@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// minBufferPoolPages keeps every page one operation touches (a root-to-leaf
+// path and the pages a split creates) in memory until it is done with them.
+const minBufferPoolPages = 32
+
+type bufferFrame struct {
+	id    uint32
+	node  *diskNode
+	dirty bool
+}
+
+// BufferPool caches decoded pages and evicts the least recently used one,
+// writing it back first if it was changed. mu lets readers holding only the
+// collection's read lock share it.
+type BufferPool struct {
+	pager    *Pager
+	capacity int
+	frames   map[uint32]*list.Element
+	lru      *list.List
+	mu       sync.Mutex
+}
+
+func NewBufferPool(pager *Pager, capacity int) *BufferPool {
+	if capacity < minBufferPoolPages {
+		capacity = minBufferPoolPages
+	}
+	return &BufferPool{
+		pager:    pager,
+		capacity: capacity,
+		frames:   make(map[uint32]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (bp *BufferPool) Get(id uint32) (*diskNode, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if element, ok := bp.frames[id]; ok {
+		bp.lru.MoveToFront(element)
+		return element.Value.(*bufferFrame).node, nil
+	}
+	page := make([]byte, pageSize)
+	if err := bp.pager.ReadPage(id, page); err != nil {
+		return nil, err
+	}
+	node, err := decodeDiskNode(page)
+	if err != nil {
+		return nil, err
+	}
+	return node, bp.add(&bufferFrame{id: id, node: node})
+}
+
+// Put stores a new or changed page; it reaches the file on eviction or Flush.
+func (bp *BufferPool) Put(id uint32, node *diskNode) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if element, ok := bp.frames[id]; ok {
+		frame := element.Value.(*bufferFrame)
+		frame.node, frame.dirty = node, true
+		bp.lru.MoveToFront(element)
+		return nil
+	}
+	return bp.add(&bufferFrame{id: id, node: node, dirty: true})
+}
+
+func (bp *BufferPool) add(frame *bufferFrame) error {
+	for bp.lru.Len() >= bp.capacity {
+		oldest := bp.lru.Back()
+		if err := bp.write(oldest.Value.(*bufferFrame)); err != nil {
+			return err
+		}
+		bp.lru.Remove(oldest)
+		delete(bp.frames, oldest.Value.(*bufferFrame).id)
+	}
+	bp.frames[frame.id] = bp.lru.PushFront(frame)
+	return nil
+}
+
+func (bp *BufferPool) write(frame *bufferFrame) error {
+	if !frame.dirty {
+		return nil
+	}
+	page, err := frame.node.encode()
+	if err != nil {
+		return err
+	}
+	if err := bp.pager.WritePage(frame.id, page); err != nil {
+		return err
+	}
+	frame.dirty = false
+	return nil
+}
+
+// Flush writes every changed page and the header and syncs the file.
+func (bp *BufferPool) Flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for element := bp.lru.Front(); element != nil; element = element.Next() {
+		if err := bp.write(element.Value.(*bufferFrame)); err != nil {
+			return err
+		}
+	}
+	return bp.pager.Sync()
+}
+
+// Reset forgets every cached page without writing it.
+func (bp *BufferPool) Reset() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.frames = make(map[uint32]*list.Element)
+	bp.lru.Init()
+}
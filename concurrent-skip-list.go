@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// concurrentSkipListNode is published only after its forward pointers are
+// set, and its own pointers are left untouched when it is unlinked, so a
+// reader standing on a removed node can still move on.
+type concurrentSkipListNode struct {
+	Key     string
+	value   atomic.Pointer[interface{}]
+	next    []atomic.Pointer[concurrentSkipListNode]
+	removed atomic.Bool
+}
+
+func (n *concurrentSkipListNode) Value() interface{} {
+	return *n.value.Load()
+}
+
+// ConcurrentSkipList lets readers run without any lock alongside one writer
+// at a time: writers serialize on mu, readers only load atomic pointers.
+type ConcurrentSkipList struct {
+	head   *concurrentSkipListNode
+	level  atomic.Int32
+	length atomic.Int64
+	mu     sync.Mutex
+}
+
+// concurrentReader marks engines that are safe to read while they are being
+// written, so TreeManager does not take its read lock for them.
+type concurrentReader interface {
+	concurrentReads()
+}
+
+func NewConcurrentSkipList() *ConcurrentSkipList {
+	list := &ConcurrentSkipList{
+		head: &concurrentSkipListNode{next: make([]atomic.Pointer[concurrentSkipListNode], skipListMaxLevel)},
+	}
+	list.level.Store(1)
+	return list
+}
+
+func (list *ConcurrentSkipList) concurrentReads() {}
+
+// predecessors returns, for every level, the last node with a key below key.
+func (list *ConcurrentSkipList) predecessors(key string) []*concurrentSkipListNode {
+	update := make([]*concurrentSkipListNode, skipListMaxLevel)
+	node := list.head
+	for i := int(list.level.Load()) - 1; i >= 0; i-- {
+		for next := node.next[i].Load(); next != nil && next.Key < key; next = node.next[i].Load() {
+			node = next
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// seek returns the first live node whose key is not less than key.
+func (list *ConcurrentSkipList) seek(key string) *concurrentSkipListNode {
+	node := list.predecessors(key)[0].next[0].Load()
+	for node != nil && node.removed.Load() {
+		node = node.next[0].Load()
+	}
+	return node
+}
+
+func (list *ConcurrentSkipList) first() *concurrentSkipListNode {
+	node := list.head.next[0].Load()
+	for node != nil && node.removed.Load() {
+		node = node.next[0].Load()
+	}
+	return node
+}
+
+// last returns the last live node, or with bounded set the last live node
+// with a key below the given one.
+func (list *ConcurrentSkipList) last(below string, bounded bool) *concurrentSkipListNode {
+	for {
+		node := list.head
+		for i := int(list.level.Load()) - 1; i >= 0; i-- {
+			for next := node.next[i].Load(); next != nil && (!bounded || next.Key < below); next = node.next[i].Load() {
+				node = next
+			}
+		}
+		if node == list.head {
+			return nil
+		}
+		if !node.removed.Load() {
+			return node
+		}
+		// Removed while we were looking: try again below its key.
+		below, bounded = node.Key, true
+	}
+}
+
+func (list *ConcurrentSkipList) Insert(key string, value interface{}) error {
+	sp := GetStringPoolManager()
+	key = sp.Get(key)
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	update := list.predecessors(key)
+	if next := update[0].next[0].Load(); next != nil && next.Key == key {
+		return ErrKeyExists
+	}
+
+	level := randomSkipListLevel()
+	for i := int(list.level.Load()); i < level; i++ {
+		update[i] = list.head
+	}
+	node := &concurrentSkipListNode{Key: key, next: make([]atomic.Pointer[concurrentSkipListNode], level)}
+	node.value.Store(&value)
+	for i := 0; i < level; i++ {
+		node.next[i].Store(update[i].next[i].Load())
+	}
+	// Linking bottom-up means a reader that sees the node on a high level
+	// will find it on every level below as well.
+	for i := 0; i < level; i++ {
+		update[i].next[i].Store(node)
+	}
+	if level > int(list.level.Load()) {
+		list.level.Store(int32(level))
+	}
+	list.length.Add(1)
+	return nil
+}
+
+func (list *ConcurrentSkipList) Get(key string) (interface{}, error) {
+	node := list.seek(key)
+	if node == nil || node.Key != key {
+		return nil, ErrKeyNotFound
+	}
+	return node.Value(), nil
+}
+
+func (list *ConcurrentSkipList) GetRange(minValue, maxValue string) ([]string, error) {
+	var result []string
+	for key := range Scan(list, RangeQuery{Min: minValue, Max: maxValue, HasMin: true, HasMax: true}) {
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+func (list *ConcurrentSkipList) Range(query RangeQuery) ([]KeyValue, error) {
+	result := make([]KeyValue, 0)
+	for key, value := range Scan(list, query) {
+		result = append(result, KeyValue{Key: key, Value: value})
+	}
+	return result, nil
+}
+
+func (list *ConcurrentSkipList) Count(minValue, maxValue string) (int, error) {
+	return countByScan(list, minValue, maxValue)
+}
+
+func (list *ConcurrentSkipList) Rank(key string) (int, error) {
+	return rankByScan(list, key)
+}
+
+func (list *ConcurrentSkipList) Select(position int) (KeyValue, error) {
+	return selectByScan(list, position)
+}
+
+// Validate checks that every level is sorted, holds only nodes tall enough
+// for it and no removed nodes, and that the bottom level matches length.
+func (list *ConcurrentSkipList) Validate() error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for i := int(list.level.Load()) - 1; i >= 0; i-- {
+		count := 0
+		var prev *concurrentSkipListNode
+		for node := list.head.next[i].Load(); node != nil; node = node.next[i].Load() {
+			path := fmt.Sprintf("level%d.%s", i, node.Key)
+			if prev != nil && node.Key <= prev.Key {
+				return corruptedAt(path, "ключ нарушает порядок")
+			}
+			if len(node.next) <= i {
+				return corruptedAt(path, "узел высоты %d на уровне %d", len(node.next), i)
+			}
+			if node.removed.Load() {
+				return corruptedAt(path, "удаленный узел остался в списке")
+			}
+			prev = node
+			count++
+		}
+		if i == 0 && int64(count) != list.length.Load() {
+			return corruptedAt("level0", "%d ключей, ожидалось %d", count, list.length.Load())
+		}
+	}
+	return nil
+}
+
+// BulkLoad replaces the contents with sorted pairs. The new nodes are linked
+// among themselves first and then published level by level, so a reader ends
+// up on either the old or the new list.
+func (list *ConcurrentSkipList) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
+		return err
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	first := make([]*concurrentSkipListNode, skipListMaxLevel)
+	last := make([]*concurrentSkipListNode, skipListMaxLevel)
+	level := 1
+	for _, pair := range pairs {
+		value := pair.Value
+		nodeLevel := randomSkipListLevel()
+		node := &concurrentSkipListNode{Key: pair.Key, next: make([]atomic.Pointer[concurrentSkipListNode], nodeLevel)}
+		node.value.Store(&value)
+		for i := 0; i < nodeLevel; i++ {
+			if last[i] == nil {
+				first[i] = node
+			} else {
+				last[i].next[i].Store(node)
+			}
+			last[i] = node
+		}
+		level = max(level, nodeLevel)
+	}
+
+	for i := max(level, int(list.level.Load())) - 1; i >= 0; i-- {
+		list.head.next[i].Store(first[i])
+	}
+	list.level.Store(int32(level))
+	list.length.Store(int64(len(pairs)))
+	return nil
+}
+
+func (list *ConcurrentSkipList) Update(key string, value interface{}) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	node := list.seek(key)
+	if node == nil || node.Key != key {
+		return ErrKeyNotFound
+	}
+	node.value.Store(&value)
+	return nil
+}
+
+func (list *ConcurrentSkipList) Remove(key string) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	update := list.predecessors(key)
+	node := update[0].next[0].Load()
+	if node == nil || node.Key != key {
+		return ErrKeyNotFound
+	}
+	node.removed.Store(true)
+	for i := len(node.next) - 1; i >= 0; i-- {
+		update[i].next[i].Store(node.next[i].Load())
+	}
+	for level := list.level.Load(); level > 1 && list.head.next[level-1].Load() == nil; level-- {
+		list.level.Store(level - 1)
+	}
+	list.length.Add(-1)
+	return nil
+}
+
+func (list *ConcurrentSkipList) Walk(fn func(key string, value interface{})) {
+	for node := list.first(); node != nil; node = node.next[0].Load() {
+		if !node.removed.Load() {
+			fn(node.Key, node.Value())
+		}
+	}
+}
+
+func (list *ConcurrentSkipList) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "skiplist"}, list)
+}
+
+func (list *ConcurrentSkipList) LoadFromFile(filename string) error {
+	return loadTreeFileInto(filename, list)
+}
+
+// concurrentSkipListIterator needs no lock either; Prev searches again from
+// the head, as nodes have no backward links.
+type concurrentSkipListIterator struct {
+	list *ConcurrentSkipList
+	node *concurrentSkipListNode
+}
+
+func (list *ConcurrentSkipList) NewIterator() Iterator {
+	return &concurrentSkipListIterator{list: list}
+}
+
+func (it *concurrentSkipListIterator) Seek(key string) bool {
+	it.node = it.list.seek(key)
+	return it.node != nil
+}
+
+func (it *concurrentSkipListIterator) Next() bool {
+	if it.node == nil {
+		it.node = it.list.first()
+		return it.node != nil
+	}
+	node := it.node.next[0].Load()
+	for node != nil && node.removed.Load() {
+		node = node.next[0].Load()
+	}
+	it.node = node
+	return it.node != nil
+}
+
+func (it *concurrentSkipListIterator) Prev() bool {
+	if it.node == nil {
+		it.node = it.list.last("", false)
+	} else {
+		it.node = it.list.last(it.node.Key, true)
+	}
+	return it.node != nil
+}
+
+func (it *concurrentSkipListIterator) Key() string {
+	return it.node.Key
+}
+
+func (it *concurrentSkipListIterator) Value() interface{} {
+	return it.node.Value()
+}
+
+func (it *concurrentSkipListIterator) Close() {
+	it.node = nil
+}
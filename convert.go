@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// convertBatchSize is how many entries a conversion copies per read lock, so
+// writers get the collection back between batches.
+const convertBatchSize = 1024
+
+// hasLayout reports whether the collection already is a treeType tree with
+// options, defaults filled in as NewTreeManagerWithOptions fills them.
+func (tc *TreeManager) hasLayout(treeType string, options TreeOptions) bool {
+	switch treeType {
+	case "btree", "bplustree":
+		if options.Order == 0 {
+			options.Order = defaultBTreeOrder
+		}
+	case "disk":
+		if options.Cache == 0 {
+			options.Cache = defaultDiskCachePages
+		}
+	case "avl", "redblack", "skiplist":
+	default:
+		treeType = "map"
+	}
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if tc.Type != treeType || tc.Options.Order != options.Order || tc.Options.Cache != options.Cache {
+		return false
+	}
+	if tc.Options.Path == "" || options.Path == "" {
+		return tc.Options.Path == options.Path
+	}
+	return samePath(tc.Options.Path, options.Path)
+}
+
+// Convert moves the collection to another engine while it stays online. The
+// entries are copied batch by batch under short read locks; keys written in
+// the meantime are remembered and settled from the old tree at the end, when
+// the new tree replaces the old one under the write lock.
+func (tc *TreeManager) Convert(treeType string, options TreeOptions) error {
+	// The checks come before the target exists: creating a disk target
+	// empties its page file, which must not be the one in use.
+	tc.mu.Lock()
+	if tc.dirty != nil {
+		tc.mu.Unlock()
+		return fmt.Errorf("%w: коллекция уже конвертируется", ErrInvalidArgument)
+	}
+	if options.Path != "" && tc.Options.Path != "" && samePath(options.Path, tc.Options.Path) {
+		tc.mu.Unlock()
+		return fmt.Errorf("%w: коллекция уже хранится в %s", ErrInvalidArgument, tc.Options.Path)
+	}
+	tc.dirty = make(map[string]struct{})
+	tc.mu.Unlock()
+
+	target, err := NewTreeManagerWithOptions(treeType, options)
+	if err != nil {
+		tc.mu.Lock()
+		tc.dirty = nil
+		tc.mu.Unlock()
+		return err
+	}
+
+	tree := target.Tree
+	last, started := "", false
+	for {
+		batch := make([]KeyValue, 0, convertBatchSize)
+		tc.mu.RLock()
+		it := tc.Tree.NewIterator()
+		ok := it.Next()
+		if started {
+			if ok = it.Seek(last); ok && it.Key() == last {
+				ok = it.Next()
+			}
+		}
+		for ; ok && len(batch) < convertBatchSize; ok = it.Next() {
+			batch = append(batch, KeyValue{Key: it.Key(), Value: it.Value()})
+		}
+		it.Close()
+		tc.mu.RUnlock()
+
+		for _, pair := range batch {
+			if err := tree.Insert(pair.Key, pair.Value); err != nil {
+				tc.mu.Lock()
+				tc.dirty = nil
+				tc.mu.Unlock()
+				target.Close()
+				return err
+			}
+		}
+		if !ok {
+			break
+		}
+		last, started = batch[len(batch)-1].Key, true
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for key := range tc.dirty {
+		value, err := tc.Tree.Get(key)
+		_, errTarget := tree.Get(key)
+		switch {
+		case err == nil && errTarget == nil:
+			err = tree.Update(key, value)
+		case err == nil:
+			err = tree.Insert(key, value)
+		case errTarget == nil:
+			err = tree.Remove(key)
+		default:
+			err = nil
+		}
+		if err != nil {
+			tc.dirty = nil
+			target.Close()
+			return err
+		}
+	}
+	tc.dirty = nil
+	old, wasChained := tc.Tree, tc.chained()
+	tc.Type = target.Type
+	tc.Options = target.Options
+	tc.setTree(tree)
+	if tc.chained() != wasChained {
+		tc.resetChains()
+	}
+	if closer, ok := old.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+const (
+	diskLeafHeader  = 11 // type, count, next, prev
+	diskInnerHeader = 7  // type, count, first child
+	// maxDiskEntry keeps at least four entries per page, so a split always
+	// leaves both halves within a page.
+	maxDiskEntry = (pageSize - diskLeafHeader) / 4
+	// defaultDiskCachePages is the buffer pool size, 4 MB, when add-collection
+	// gives no cache=N.
+	defaultDiskCachePages = 1024
+)
+
+// diskNode is the decoded form of a page. Leaves hold JSON-encoded values and
+// are linked both ways through page numbers (0, the header page, means none);
+// in an inner node Keys[i] is the smallest key under Children[i+1].
+type diskNode struct {
+	Leaf     bool
+	Keys     []string
+	Values   [][]byte
+	Children []uint32
+	Next     uint32
+	Prev     uint32
+}
+
+func (n *diskNode) size() int {
+	if n.Leaf {
+		size := diskLeafHeader
+		for i, key := range n.Keys {
+			size += 4 + len(key) + len(n.Values[i])
+		}
+		return size
+	}
+	size := diskInnerHeader
+	for _, key := range n.Keys {
+		size += 6 + len(key)
+	}
+	return size
+}
+
+func (n *diskNode) encode() ([]byte, error) {
+	if n.size() > pageSize {
+		return nil, fmt.Errorf("%w: узел не помещается в страницу", ErrCorruptedTree)
+	}
+	page := make([]byte, pageSize)
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(n.Keys)))
+	offset := 0
+	if n.Leaf {
+		page[0] = 1
+		binary.LittleEndian.PutUint32(page[3:], n.Next)
+		binary.LittleEndian.PutUint32(page[7:], n.Prev)
+		offset = diskLeafHeader
+	} else {
+		page[0] = 2
+		binary.LittleEndian.PutUint32(page[3:], n.Children[0])
+		offset = diskInnerHeader
+	}
+	for i, key := range n.Keys {
+		binary.LittleEndian.PutUint16(page[offset:], uint16(len(key)))
+		offset += 2 + copy(page[offset+2:], key)
+		if n.Leaf {
+			binary.LittleEndian.PutUint16(page[offset:], uint16(len(n.Values[i])))
+			offset += 2 + copy(page[offset+2:], n.Values[i])
+		} else {
+			binary.LittleEndian.PutUint32(page[offset:], n.Children[i+1])
+			offset += 4
+		}
+	}
+	return page, nil
+}
+
+func decodeDiskNode(page []byte) (*diskNode, error) {
+	n := &diskNode{}
+	count := int(binary.LittleEndian.Uint16(page[1:]))
+	offset := 0
+	switch page[0] {
+	case 1:
+		n.Leaf = true
+		n.Next = binary.LittleEndian.Uint32(page[3:])
+		n.Prev = binary.LittleEndian.Uint32(page[7:])
+		offset = diskLeafHeader
+	case 2:
+		n.Children = []uint32{binary.LittleEndian.Uint32(page[3:])}
+		offset = diskInnerHeader
+	default:
+		return nil, fmt.Errorf("%w: неизвестный тип страницы %d", ErrCorruptedTree, page[0])
+	}
+
+	read := func(length int) ([]byte, error) {
+		if offset+length > len(page) {
+			return nil, fmt.Errorf("%w: запись выходит за границу страницы", ErrCorruptedTree)
+		}
+		data := page[offset : offset+length]
+		offset += length
+		return data, nil
+	}
+	for i := 0; i < count; i++ {
+		length, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+		key, err := read(int(binary.LittleEndian.Uint16(length)))
+		if err != nil {
+			return nil, err
+		}
+		n.Keys = append(n.Keys, string(key))
+		if n.Leaf {
+			if length, err = read(2); err != nil {
+				return nil, err
+			}
+			value, err := read(int(binary.LittleEndian.Uint16(length)))
+			if err != nil {
+				return nil, err
+			}
+			n.Values = append(n.Values, append([]byte(nil), value...))
+		} else {
+			child, err := read(4)
+			if err != nil {
+				return nil, err
+			}
+			n.Children = append(n.Children, binary.LittleEndian.Uint32(child))
+		}
+	}
+	return n, nil
+}
+
+func (n *diskNode) search(key string) (int, bool) {
+	i := 0
+	for i < len(n.Keys) && n.Keys[i] < key {
+		i++
+	}
+	return i, i < len(n.Keys) && n.Keys[i] == key
+}
+
+func (n *diskNode) childIndex(key string) int {
+	i := 0
+	for i < len(n.Keys) && key >= n.Keys[i] {
+		i++
+	}
+	return i
+}
+
+// DiskBTree is a B+ tree kept in a page file and reached through a buffer
+// pool, so only the recently used pages stay in memory. Values are stored as
+// JSON. Deletes do not merge pages: an emptied leaf stays in the chain until
+// the next BulkLoad.
+type DiskBTree struct {
+	pager *Pager
+	pool  *BufferPool
+}
+
+// diskSplit is what a node that outgrew its page hands to its parent.
+type diskSplit struct {
+	Key   string
+	Right uint32
+}
+
+func OpenDiskBTree(path string, cachePages int) (*DiskBTree, error) {
+	pager, err := OpenPager(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &DiskBTree{pager: pager, pool: NewBufferPool(pager, cachePages)}
+	if pager.Root == 0 {
+		pager.Root = pager.Allocate()
+		if err := t.pool.Put(pager.Root, &diskNode{Leaf: true}); err != nil {
+			pager.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// CreateDiskBTree opens path as an empty tree, dropping the pages it held.
+// A file that is not a page file is refused rather than overwritten.
+func CreateDiskBTree(path string, cachePages int) (*DiskBTree, error) {
+	t, err := OpenDiskBTree(path, cachePages)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.BulkLoad(nil); err != nil {
+		t.pager.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *DiskBTree) findLeaf(key string) (*diskNode, error) {
+	node, err := t.pool.Get(t.pager.Root)
+	for err == nil && !node.Leaf {
+		node, err = t.pool.Get(node.Children[node.childIndex(key)])
+	}
+	return node, err
+}
+
+// edgeLeaf returns the page number of the first or the last leaf.
+func (t *DiskBTree) edgeLeaf(first bool) (uint32, *diskNode, error) {
+	id := t.pager.Root
+	for {
+		node, err := t.pool.Get(id)
+		if err != nil || node.Leaf {
+			return id, node, err
+		}
+		if first {
+			id = node.Children[0]
+		} else {
+			id = node.Children[len(node.Children)-1]
+		}
+	}
+}
+
+// modify runs change on the leaf for key and splits every page on the way
+// back up that no longer fits.
+func (t *DiskBTree) modify(key string, change func(leaf *diskNode, i int, found bool) error) error {
+	oldRoot := t.pager.Root
+	split, err := t.modifyNode(oldRoot, key, change)
+	if err != nil || split == nil {
+		return err
+	}
+	root := t.pager.Allocate()
+	t.pager.Root = root
+	return t.pool.Put(root, &diskNode{Keys: []string{split.Key}, Children: []uint32{oldRoot, split.Right}})
+}
+
+func (t *DiskBTree) modifyNode(id uint32, key string, change func(leaf *diskNode, i int, found bool) error) (*diskSplit, error) {
+	node, err := t.pool.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if node.Leaf {
+		i, found := node.search(key)
+		if err := change(node, i, found); err != nil {
+			return nil, err
+		}
+	} else {
+		i := node.childIndex(key)
+		split, err := t.modifyNode(node.Children[i], key, change)
+		if err != nil || split == nil {
+			return nil, err
+		}
+		node.Keys = append(node.Keys[:i], append([]string{split.Key}, node.Keys[i:]...)...)
+		node.Children = append(node.Children[:i+1], append([]uint32{split.Right}, node.Children[i+1:]...)...)
+	}
+	if err := t.pool.Put(id, node); err != nil {
+		return nil, err
+	}
+	if node.size() <= pageSize {
+		return nil, nil
+	}
+	return t.split(id, node)
+}
+
+// split moves the upper half of node, by bytes, to a new page.
+func (t *DiskBTree) split(id uint32, node *diskNode) (*diskSplit, error) {
+	half, mid := node.size()/2, 0
+	for size := 0; mid < len(node.Keys)-1 && size < half; mid++ {
+		if node.Leaf {
+			size += 4 + len(node.Keys[mid]) + len(node.Values[mid])
+		} else {
+			size += 6 + len(node.Keys[mid])
+		}
+	}
+	if mid == 0 {
+		mid = 1
+	}
+
+	rightID := t.pager.Allocate()
+	right := &diskNode{Leaf: node.Leaf}
+	var separator string
+	if node.Leaf {
+		separator = node.Keys[mid]
+		right.Keys = append(right.Keys, node.Keys[mid:]...)
+		right.Values = append(right.Values, node.Values[mid:]...)
+		node.Keys, node.Values = node.Keys[:mid:mid], node.Values[:mid:mid]
+
+		right.Next, right.Prev = node.Next, id
+		if node.Next != 0 {
+			next, err := t.pool.Get(node.Next)
+			if err != nil {
+				return nil, err
+			}
+			next.Prev = rightID
+			if err := t.pool.Put(node.Next, next); err != nil {
+				return nil, err
+			}
+		}
+		node.Next = rightID
+	} else {
+		separator = node.Keys[mid]
+		right.Keys = append(right.Keys, node.Keys[mid+1:]...)
+		right.Children = append(right.Children, node.Children[mid+1:]...)
+		node.Keys, node.Children = node.Keys[:mid:mid], node.Children[:mid+1:mid+1]
+	}
+
+	if err := t.pool.Put(id, node); err != nil {
+		return nil, err
+	}
+	if err := t.pool.Put(rightID, right); err != nil {
+		return nil, err
+	}
+	return &diskSplit{Key: separator, Right: rightID}, nil
+}
+
+func encodeDiskEntry(key string, value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(key)+len(data)+4 > maxDiskEntry {
+		return nil, fmt.Errorf("%w: ключ и значение длиннее %d байт", ErrInvalidArgument, maxDiskEntry)
+	}
+	return data, nil
+}
+
+func decodeDiskValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+func (t *DiskBTree) Insert(key string, value interface{}) error {
+	data, err := encodeDiskEntry(key, value)
+	if err != nil {
+		return err
+	}
+	return t.modify(key, func(leaf *diskNode, i int, found bool) error {
+		if found {
+			return ErrKeyExists
+		}
+		leaf.Keys = append(leaf.Keys[:i], append([]string{key}, leaf.Keys[i:]...)...)
+		leaf.Values = append(leaf.Values[:i], append([][]byte{data}, leaf.Values[i:]...)...)
+		return nil
+	})
+}
+
+func (t *DiskBTree) Get(key string) (interface{}, error) {
+	leaf, err := t.findLeaf(key)
+	if err != nil {
+		return nil, err
+	}
+	i, found := leaf.search(key)
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return decodeDiskValue(leaf.Values[i])
+}
+
+// diskScanSource hands Scan an iterator the caller keeps, so the read error
+// that ended the scan can be looked at afterwards.
+type diskScanSource struct {
+	it *diskIterator
+}
+
+func (s diskScanSource) NewIterator() Iterator {
+	return s.it
+}
+
+// scan is Scan that also returns the error of a page or value it could not
+// read: such a scan ends early and would look like a shorter range.
+func (t *DiskBTree) scan(query RangeQuery, fn func(key string, value interface{})) error {
+	it := &diskIterator{tree: t}
+	for key, value := range Scan(diskScanSource{it}, query) {
+		fn(key, value)
+	}
+	return it.err
+}
+
+func (t *DiskBTree) GetRange(minValue, maxValue string) ([]string, error) {
+	var result []string
+	err := t.scan(RangeQuery{Min: minValue, Max: maxValue, HasMin: true, HasMax: true}, func(key string, _ interface{}) {
+		result = append(result, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *DiskBTree) Range(query RangeQuery) ([]KeyValue, error) {
+	result := make([]KeyValue, 0)
+	err := t.scan(query, func(key string, value interface{}) {
+		result = append(result, KeyValue{Key: key, Value: value})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *DiskBTree) Count(minValue, maxValue string) (int, error) {
+	count := 0
+	err := t.scan(RangeQuery{Min: minValue, Max: maxValue, HasMin: true, HasMax: true}, func(string, interface{}) {
+		count++
+	})
+	return count, err
+}
+
+func (t *DiskBTree) Rank(key string) (int, error) {
+	return rankByScan(t, key)
+}
+
+func (t *DiskBTree) Select(position int) (KeyValue, error) {
+	return selectByScan(t, position)
+}
+
+func (t *DiskBTree) Update(key string, value interface{}) error {
+	data, err := encodeDiskEntry(key, value)
+	if err != nil {
+		return err
+	}
+	return t.modify(key, func(leaf *diskNode, i int, found bool) error {
+		if !found {
+			return ErrKeyNotFound
+		}
+		leaf.Values[i] = data
+		return nil
+	})
+}
+
+func (t *DiskBTree) Remove(key string) error {
+	return t.modify(key, func(leaf *diskNode, i int, found bool) error {
+		if !found {
+			return ErrKeyNotFound
+		}
+		leaf.Keys = append(leaf.Keys[:i], leaf.Keys[i+1:]...)
+		leaf.Values = append(leaf.Values[:i], leaf.Values[i+1:]...)
+		return nil
+	})
+}
+
+func (t *DiskBTree) Walk(fn func(key string, value interface{})) {
+	it := t.NewIterator()
+	defer it.Close()
+	for it.Next() {
+		fn(it.Key(), it.Value())
+	}
+}
+
+// BulkLoad replaces the file contents with sorted pairs, filling each leaf
+// page before starting the next and building the inner levels on top.
+func (t *DiskBTree) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
+		return err
+	}
+	values := make([][]byte, len(pairs))
+	for i, pair := range pairs {
+		data, err := encodeDiskEntry(pair.Key, pair.Value)
+		if err != nil {
+			return err
+		}
+		values[i] = data
+	}
+
+	t.pool.Reset()
+	if err := t.pager.Reset(); err != nil {
+		return err
+	}
+	ids := []uint32{t.pager.Allocate()}
+	nodes := []*diskNode{{Leaf: true}}
+	lowKeys := []string{""}
+	for i, pair := range pairs {
+		leaf := nodes[len(nodes)-1]
+		if len(leaf.Keys) > 0 && leaf.size()+4+len(pair.Key)+len(values[i]) > pageSize {
+			id := t.pager.Allocate()
+			leaf.Next = id
+			leaf = &diskNode{Leaf: true, Prev: ids[len(ids)-1]}
+			ids, nodes, lowKeys = append(ids, id), append(nodes, leaf), append(lowKeys, pair.Key)
+		}
+		leaf.Keys = append(leaf.Keys, pair.Key)
+		leaf.Values = append(leaf.Values, values[i])
+	}
+	for len(nodes) > 1 {
+		var parentIDs []uint32
+		var parents []*diskNode
+		var parentLowKeys []string
+		for i := range nodes {
+			var parent *diskNode
+			if len(parents) > 0 {
+				parent = parents[len(parents)-1]
+			}
+			if parent == nil || parent.size()+6+len(lowKeys[i]) > pageSize {
+				parent = &diskNode{Children: []uint32{ids[i]}}
+				parentIDs = append(parentIDs, t.pager.Allocate())
+				parents = append(parents, parent)
+				parentLowKeys = append(parentLowKeys, lowKeys[i])
+				continue
+			}
+			parent.Keys = append(parent.Keys, lowKeys[i])
+			parent.Children = append(parent.Children, ids[i])
+		}
+		for i, node := range nodes {
+			if err := t.pool.Put(ids[i], node); err != nil {
+				return err
+			}
+		}
+		ids, nodes, lowKeys = parentIDs, parents, parentLowKeys
+	}
+	if err := t.pool.Put(ids[0], nodes[0]); err != nil {
+		return err
+	}
+	t.pager.Root = ids[0]
+	return nil
+}
+
+// diskIterator walks the leaf chain by page number. A page that cannot be
+// read ends the walk; the error is logged since Iterator has no way to
+// report it.
+type diskIterator struct {
+	tree  *DiskBTree
+	id    uint32
+	leaf  *diskNode
+	index int
+	err   error
+}
+
+func (t *DiskBTree) NewIterator() Iterator {
+	return &diskIterator{tree: t}
+}
+
+// fail ends the iteration on a page that could not be read and keeps the
+// first such error for scan.
+func (it *diskIterator) fail(err error) bool {
+	log.Printf("Ошибка чтения страницы: %v", err)
+	if it.err == nil {
+		it.err = err
+	}
+	it.leaf = nil
+	return false
+}
+
+func (it *diskIterator) load(id uint32) bool {
+	if id == 0 {
+		it.leaf = nil
+		return false
+	}
+	leaf, err := it.tree.pool.Get(id)
+	if err != nil {
+		return it.fail(err)
+	}
+	it.id, it.leaf = id, leaf
+	return true
+}
+
+func (it *diskIterator) Seek(key string) bool {
+	id := it.tree.pager.Root
+	for {
+		if !it.load(id) {
+			return false
+		}
+		if it.leaf.Leaf {
+			break
+		}
+		id = it.leaf.Children[it.leaf.childIndex(key)]
+	}
+	it.index, _ = it.leaf.search(key)
+	it.index--
+	return it.Next()
+}
+
+func (it *diskIterator) Next() bool {
+	if it.leaf == nil {
+		id, leaf, err := it.tree.edgeLeaf(true)
+		if err != nil {
+			return it.fail(err)
+		}
+		it.id, it.leaf, it.index = id, leaf, -1
+	}
+	it.index++
+	for it.index >= len(it.leaf.Keys) {
+		if !it.load(it.leaf.Next) {
+			return false
+		}
+		it.index = 0
+	}
+	return true
+}
+
+func (it *diskIterator) Prev() bool {
+	if it.leaf == nil {
+		id, leaf, err := it.tree.edgeLeaf(false)
+		if err != nil {
+			return it.fail(err)
+		}
+		it.id, it.leaf, it.index = id, leaf, len(leaf.Keys)
+	}
+	it.index--
+	for it.index < 0 {
+		if !it.load(it.leaf.Prev) {
+			return false
+		}
+		it.index = len(it.leaf.Keys) - 1
+	}
+	return true
+}
+
+func (it *diskIterator) Key() string {
+	return it.leaf.Keys[it.index]
+}
+
+func (it *diskIterator) Value() interface{} {
+	value, err := decodeDiskValue(it.leaf.Values[it.index])
+	if err != nil {
+		log.Printf("Ошибка чтения значения %s: %v", it.Key(), err)
+		if it.err == nil {
+			it.err = err
+		}
+	}
+	return value
+}
+
+func (it *diskIterator) Close() {
+	it.leaf = nil
+}
+
+// Validate checks key order and separators, that every page fits, a single
+// leaf depth, and that the leaf chain links every leaf in order both ways.
+func (t *DiskBTree) Validate() error {
+	leafDepth := -1
+	leaves := make([]uint32, 0)
+
+	var validate func(id uint32, path string, depth int, low, high *string) error
+	validate = func(id uint32, path string, depth int, low, high *string) error {
+		if id == 0 || id >= t.pager.PageCount {
+			return corruptedAt(path, "ссылка на несуществующую страницу %d", id)
+		}
+		node, err := t.pool.Get(id)
+		if err != nil {
+			return corruptedAt(path, "страница %d: %v", id, err)
+		}
+		if node.size() > pageSize {
+			return corruptedAt(path, "страница %d переполнена", id)
+		}
+		for i, key := range node.Keys {
+			if i > 0 && key <= node.Keys[i-1] || low != nil && key < *low || high != nil && key >= *high {
+				return corruptedAt(path, "ключ %s нарушает порядок", key)
+			}
+		}
+
+		if node.Leaf {
+			if len(node.Values) != len(node.Keys) {
+				return corruptedAt(path, "%d ключей, но %d значений", len(node.Keys), len(node.Values))
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return corruptedAt(path, "лист на глубине %d, остальные на %d", depth, leafDepth)
+			}
+			leaves = append(leaves, id)
+			return nil
+		}
+		if len(node.Children) != len(node.Keys)+1 {
+			return corruptedAt(path, "%d ключей, но %d потомков", len(node.Keys), len(node.Children))
+		}
+		for i, child := range node.Children {
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = &node.Keys[i-1]
+			}
+			if i < len(node.Keys) {
+				childHigh = &node.Keys[i]
+			}
+			if err := validate(child, fmt.Sprintf("%s.%d", path, i), depth+1, childLow, childHigh); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := validate(t.pager.Root, "root", 0, nil, nil); err != nil {
+		return err
+	}
+
+	for i, id := range leaves {
+		leaf, err := t.pool.Get(id)
+		if err != nil {
+			return err
+		}
+		var prev, next uint32
+		if i > 0 {
+			prev = leaves[i-1]
+		}
+		if i < len(leaves)-1 {
+			next = leaves[i+1]
+		}
+		if leaf.Prev != prev || leaf.Next != next {
+			return fmt.Errorf("%w: цепочка листьев разорвана у страницы %d", ErrCorruptedTree, id)
+		}
+	}
+	return nil
+}
+
+// Flush writes every changed page and the header to the page file.
+func (t *DiskBTree) Flush() error {
+	return t.pool.Flush()
+}
+
+func (t *DiskBTree) Close() error {
+	if err := t.Flush(); err != nil {
+		t.pager.Close()
+		return err
+	}
+	return t.pager.Close()
+}
+
+func (t *DiskBTree) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "disk"}, t)
+}
+
+func (t *DiskBTree) LoadFromFile(filename string) error {
+	return loadTreeFileInto(filename, t)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fillDiskBTree(t *testing.T, tree *DiskBTree, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(fmt.Sprintf("k%06d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestDiskBTreeReopenAfterKill drops a tree whose small cache has already
+// written pages without ever flushing it, as a killed process would. The file
+// must still open.
+func TestDiskBTreeReopenAfterKill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.pages")
+	tree, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillDiskBTree(t, tree, 20000)
+	tree.pager.file.Close()
+
+	reopened, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskBTreeReopenAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.pages")
+	tree, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillDiskBTree(t, tree, 20000)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := reopened.Count("k", "l"); count != 20000 {
+		t.Fatalf("reopened tree has %d keys, want 20000", count)
+	}
+}
+
+// TestDiskBTreeZeroHeader opens a file written before headers went out on
+// creation: pages were evicted but page 0 was never written.
+func TestDiskBTreeZeroHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.pages")
+	page := make([]byte, 2*pageSize)
+	page[pageSize] = 1
+	if err := os.WriteFile(path, page, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	fillDiskBTree(t, tree, 100)
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolManagerCloseFlushesDisk(t *testing.T) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	path := filepath.Join(t.TempDir(), "c.pages")
+	pools := NewPoolManager()
+	for _, command := range []string{"add-pool p", "add-schema p s", "add-collection p s c disk path=" + path + " cache=32"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	collection, _ := pools.GetCollection("p", "s", "c")
+	for i := 0; i < 5000; i++ {
+		if err := collection.InsertData(fmt.Sprintf("k%06d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pools.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if count, _ := tree.Count("k", "l"); count != 5000 {
+		t.Fatalf("reopened tree has %d keys, want 5000", count)
+	}
+}
+
+// TestDiskCollectionReplay replays a log that creates a disk collection over
+// a page file which already holds the logged keys, as it does after a crash.
+func TestDiskCollectionReplay(t *testing.T) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "c.pages")
+	wal, err := OpenWriteAheadLog(filepath.Join(dir, "wal"), WALSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools := NewPoolManager()
+	pools.WAL = wal
+	for _, command := range []string{"add-pool p", "add-schema p s", "add-collection p s c disk path=" + path, "insert-data p s c a 1", "insert-data p s c b 2"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	pools.Close()
+	wal.Close()
+
+	wal, err = OpenWriteAheadLog(filepath.Join(dir, "wal"), WALSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	replayed := NewPoolManager()
+	defer replayed.Close()
+	if _, err := wal.Replay(0, replayed.replayRecord); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := replayed.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := collection.Get("b"); err != nil || value != "2" {
+		t.Fatalf("b = %v, %v", value, err)
+	}
+}
+
+func TestDiskCollectionSaveState(t *testing.T) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	dir := t.TempDir()
+	save := filepath.Join(dir, "state")
+	pools := NewPoolManager()
+	defer pools.Close()
+	for _, command := range []string{"add-pool p", "add-schema p s", "add-collection p s c disk path=" + filepath.Join(dir, "c.pages") + " cache=32"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	collection, _ := pools.GetCollection("p", "s", "c")
+	for i := 0; i < 3000; i++ {
+		collection.InsertData(fmt.Sprintf("k%06d", i), "v")
+	}
+	for i := 0; i < 2; i++ {
+		if err := pools.SaveToFile(save); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copies, _ := filepath.Glob(save + ".*.pages")
+	if len(copies) != 1 {
+		t.Fatalf("page file copies after two saves: %v", copies)
+	}
+
+	collection.InsertData("later", "v")
+	if err := pools.LoadFromFile(save); err != nil {
+		t.Fatal(err)
+	}
+	collection, _ = pools.GetCollection("p", "s", "c")
+	if _, err := collection.Get("later"); err == nil {
+		t.Fatal("a key written after the save survived loading it")
+	}
+	if count, _ := collection.Count("k", "l"); count != 3000 {
+		t.Fatalf("loaded collection has %d keys, want 3000", count)
+	}
+
+	// A damaged copy fails the load before the live collection is touched.
+	collection.InsertData("later", "v")
+	data, _ := os.ReadFile(copies[0])
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(copies[0], data, 0644)
+	if err := pools.LoadFromFile(save); err == nil {
+		t.Fatal("loaded a damaged page file copy")
+	}
+	if _, err := collection.Get("later"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDiskPathInUse makes sure no command empties the page file of an open
+// collection by creating another one over it.
+func TestDiskPathInUse(t *testing.T) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	path := filepath.Join(t.TempDir(), "c.pages")
+	pools := NewPoolManager()
+	defer pools.Close()
+	for _, command := range []string{"add-pool p", "add-schema p s", "add-collection p s c disk path=" + path, "insert-data p s c a 1"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	for _, command := range []string{
+		"add-collection p s c disk path=" + path,
+		"add-collection p s d disk path=" + path,
+		"convert-collection p s c disk path=" + path + " cache=64",
+	} {
+		if err := runCommand(pools, command); err == nil {
+			t.Fatalf("%s: accepted", command)
+		}
+	}
+	collection, _ := pools.GetCollection("p", "s", "c")
+	if value, err := collection.Get("a"); err != nil || value != "1" {
+		t.Fatalf("a = %v, %v", value, err)
+	}
+}
+
+// TestDiskRangeReadError damages a leaf in the middle of the chain: a range
+// that reaches it has to fail instead of coming back shorter.
+func TestDiskRangeReadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.pages")
+	tree, err := OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillDiskBTree(t, tree, 5000)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := false
+	for offset := pageSize; offset < len(data) && !damaged; offset += pageSize {
+		if node, err := decodeDiskNode(data[offset : offset+pageSize]); err == nil && node.Leaf && node.Prev != 0 && node.Next != 0 {
+			data[offset] = 0xff
+			damaged = true
+		}
+	}
+	if !damaged {
+		t.Fatal("no leaf in the middle of the chain")
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenDiskBTree(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if _, err := tree.Range(RangeQuery{Limit: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, err := tree.Range(RangeQuery{}); !errors.Is(err, ErrCorruptedTree) {
+		t.Fatalf("range over a damaged leaf gave %d pairs, %v", len(pairs), err)
+	}
+	if _, err := tree.Count("k", "l"); !errors.Is(err, ErrCorruptedTree) {
+		t.Fatalf("count over a damaged leaf: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrKeyExists           = errors.New("элемент с таким ключом уже существует")
+	ErrKeyNotFound         = errors.New("элемент не найден")
+	ErrPoolNotFound        = errors.New("пул не найден")
+	ErrSchemaNotFound      = errors.New("схема не найдена")
+	ErrCollectionNotFound  = errors.New("коллекция не найдена")
+	ErrCollectionExists    = errors.New("коллекция с таким именем уже существует")
+	ErrNotEnoughArguments  = errors.New("недостаточно аргументов")
+	ErrInvalidArgument     = errors.New("неверный аргумент")
+	ErrUnknownCommand      = errors.New("неизвестная команда")
+	ErrCorruptedChain      = errors.New("цепочка команд ключа повреждена")
+	ErrCorruptedTree       = errors.New("нарушена структура дерева")
+	ErrTransactionNotFound = errors.New("транзакция не найдена")
+	ErrTransactionConflict = errors.New("ключ изменен другой транзакцией")
+	ErrSnapshotNotFound    = errors.New("снимок не найден")
+	ErrWriteAheadLogFailed = errors.New("команда выполнена, но не записана в журнал")
+	ErrCorruptedStateFile  = errors.New("файл сохранения поврежден")
+)
+
+func notEnoughArguments(command string) error {
+	return fmt.Errorf("%w для команды %s", ErrNotEnoughArguments, command)
+}
+
+func corruptedAt(path string, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: узел %s: %s", ErrCorruptedTree, path, fmt.Sprintf(format, args...))
+}
+
+func positionNotFound(position int) error {
+	return fmt.Errorf("%w: нет ключа на позиции %d", ErrKeyNotFound, position)
+}
+
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrCorruptedChain):
+		return http.StatusInternalServerError, "corrupted_chain"
+	case errors.Is(err, ErrCorruptedTree):
+		return http.StatusInternalServerError, "corrupted_tree"
+	case errors.Is(err, ErrCorruptedStateFile):
+		return http.StatusUnprocessableEntity, "corrupted_state_file"
+	case errors.Is(err, ErrKeyNotFound):
+		return http.StatusNotFound, "key_not_found"
+	case errors.Is(err, ErrPoolNotFound):
+		return http.StatusNotFound, "pool_not_found"
+	case errors.Is(err, ErrSchemaNotFound):
+		return http.StatusNotFound, "schema_not_found"
+	case errors.Is(err, ErrCollectionNotFound):
+		return http.StatusNotFound, "collection_not_found"
+	case errors.Is(err, ErrTransactionNotFound):
+		return http.StatusNotFound, "transaction_not_found"
+	case errors.Is(err, ErrSnapshotNotFound):
+		return http.StatusNotFound, "snapshot_not_found"
+	case errors.Is(err, ErrTransactionConflict):
+		return http.StatusConflict, "transaction_conflict"
+	case errors.Is(err, ErrKeyExists):
+		return http.StatusConflict, "key_exists"
+	case errors.Is(err, ErrCollectionExists):
+		return http.StatusConflict, "collection_exists"
+	case errors.Is(err, ErrNotEnoughArguments):
+		return http.StatusBadRequest, "not_enough_arguments"
+	case errors.Is(err, ErrInvalidArgument):
+		return http.StatusBadRequest, "invalid_argument"
+	case errors.Is(err, ErrUnknownCommand):
+		return http.StatusBadRequest, "unknown_command"
+	default:
+		return http.StatusInternalServerError, "internal_error"
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	data, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}{Error: err.Error(), Code: code})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
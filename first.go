@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -9,7 +10,7 @@ import (
 func handlePoolsAndSchemas(pools *PoolManager, args []string) error {
 	pools.ShowAll()
 	if len(args) < 2 {
-		return fmt.Errorf("недостаточно аргументов для команды %s", args[0])
+		return notEnoughArguments(args[0])
 	}
 
 	switch args[0] {
@@ -19,122 +20,522 @@ func handlePoolsAndSchemas(pools *PoolManager, args []string) error {
 		pools.RemovePool(args[1])
 	case "add-schema":
 		if len(args) < 3 {
-			return fmt.Errorf("недостаточно аргументов для команды add-schema")
+			return notEnoughArguments("add-schema")
 		}
-		pool, err := pools.GetPool(args[1])
-		if err != nil {
-			return err
-		}
-		pool.AddSchema(args[2])
+		return pools.AddSchema(args[1], args[2])
 	case "remove-schema":
 		if len(args) < 3 {
-			return fmt.Errorf("недостаточно аргументов для команды remove-schema")
-		}
-		pool, err := pools.GetPool(args[1])
-		if err != nil {
-			return err
+			return notEnoughArguments("remove-schema")
 		}
-		pool.RemoveSchema(args[2])
+		return pools.RemoveSchema(args[1], args[2])
 	case "add-collection":
 		if len(args) < 5 {
-			return fmt.Errorf("недостаточно аргументов для команды add-collection")
+			return notEnoughArguments("add-collection")
 		}
 		collectionType := args[4]
-		pool, err := pools.GetPool(args[1])
+		options, err := ParseTreeOptions(args[5:])
 		if err != nil {
 			return err
 		}
-		treeCollection := NewTreeManager(collectionType)
-		if err = pool.AddCollection(args[2], args[3], *treeCollection); err != nil {
+		if err := pools.checkDiskPath(options.Path); err != nil {
 			return err
 		}
+		treeCollection, err := NewTreeManagerWithOptions(collectionType, options)
+		if err != nil {
+			return err
+		}
+		if err := pools.AddCollection(args[1], args[2], args[3], treeCollection); err != nil {
+			treeCollection.Close()
+			return err
+		}
+		return nil
 	case "remove-collection":
 		if len(args) < 4 {
-			return fmt.Errorf("недостаточно аргументов для команды remove-collection")
+			return notEnoughArguments("remove-collection")
 		}
-		pool, err := pools.GetPool(args[1])
+		return pools.RemoveCollection(args[1], args[2], args[3])
+	case "convert-collection":
+		if len(args) < 5 {
+			return notEnoughArguments("convert-collection")
+		}
+		options, err := ParseTreeOptions(args[5:])
 		if err != nil {
 			return err
 		}
-		schema, err := pool.GetSchema(args[2])
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
 		if err != nil {
 			return err
 		}
-		schema.RemoveCollection(args[3])
+		// A replayed conversion may find the collection already converted
+		// by a save that ran alongside it.
+		if collection.hasLayout(args[4], options) {
+			fmt.Println("Коллекция", args[3], "уже имеет тип", args[4])
+			return nil
+		}
+		if err := pools.checkDiskPath(options.Path); err != nil {
+			return err
+		}
+		if err := collection.Convert(args[4], options); err != nil {
+			return err
+		}
+		fmt.Println("Коллекция", args[3], "переведена на тип", collection.Type)
 	default:
-		return fmt.Errorf("неизвестная команда")
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, args[0])
 	}
 	return nil
 }
 
-func runCommand(pools *PoolManager, command string, cr *ChainOfResponsibility) error {
+func runCommand(pools *PoolManager, command string) error {
 	args := strings.Fields(command)
 	if len(args) == 0 {
-		return fmt.Errorf("не указана команда")
+		return fmt.Errorf("%w: не указана команда", ErrNotEnoughArguments)
+	}
+	// Mutations are serialized while a log is attached so that records are
+	// written in the same order the commands took effect. A conversion does
+	// not change any data, so it runs alongside the writes it has to follow.
+	if pools.WAL != nil && (walCommands[args[0]] || loadCommands[args[0]]) && args[0] != "convert-collection" {
+		pools.writeMu.Lock()
+		defer pools.writeMu.Unlock()
+	}
+	if loadCommands[args[0]] {
+		if err := pools.checkLoad(); err != nil {
+			return err
+		}
+	}
+	if err := executeCommand(pools, args); err != nil {
+		return err
+	}
+	if walCommands[args[0]] || loadCommands[args[0]] {
+		pools.noteMutation()
+	}
+	if loadCommands[args[0]] {
+		return pools.checkpoint()
 	}
+	return pools.logCommand(args)
+}
 
+func executeCommand(pools *PoolManager, args []string) error {
 	switch args[0] {
-	case "add-pool", "remove-pool", "add-schema", "remove-schema", "add-collection", "remove-collection":
+	case "add-pool", "remove-pool", "add-schema", "remove-schema", "add-collection", "remove-collection", "convert-collection":
 		return handlePoolsAndSchemas(pools, args)
 	case "insert-data":
-		if len(args) < 5 {
-			return fmt.Errorf("недостаточно аргументов для команды insert-data")
+		if len(args) < 6 {
+			return notEnoughArguments("insert-data")
 		}
-		data := TData{Key: args[3], Value: args[4]}
-		insertCmd := &InsertCommand{InitialVersion: data}
-		cr.AddHandler(insertCmd)
-		fmt.Println("Команда вставки добавлена")
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if err := collection.InsertData(args[4], args[5]); err != nil {
+			return err
+		}
+		fmt.Println("Данные вставлены в коллекцию", args[3], "с ключом", args[4])
+	case "batch-insert":
+		if len(args) < 6 {
+			return notEnoughArguments("batch-insert")
+		}
+		if len(args[4:])%2 != 0 {
+			return fmt.Errorf("%w: ключи и значения должны идти парами", ErrInvalidArgument)
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		pairs := make([]KeyValue, 0, len(args[4:])/2)
+		for i := 4; i < len(args); i += 2 {
+			pairs = append(pairs, KeyValue{Key: args[i], Value: args[i+1]})
+		}
+		if err := collection.BulkInsert(pairs); err != nil {
+			return err
+		}
+		fmt.Println("В коллекцию", args[3], "вставлено элементов:", len(pairs))
 	case "update-data":
-		if len(args) < 4 {
-			return fmt.Errorf("недостаточно аргументов для команды update-data")
+		if len(args) < 6 {
+			return notEnoughArguments("update-data")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if err := collection.UpdateData(args[4], args[5]); err != nil {
+			return err
 		}
-		updateCmd := &UpdateCommand{UpdateExpression: args[3]}
-		cr.AddHandler(updateCmd)
-		fmt.Println("Команда обновления добавлена")
+		fmt.Println("Данные с ключом", args[4], "обновлены в коллекции", args[3])
 	case "delete-data":
-		if len(args) < 3 {
-			return fmt.Errorf("недостаточно аргументов для команды delete-data")
+		if len(args) < 5 {
+			return notEnoughArguments("delete-data")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if err := collection.DeleteData(args[4]); err != nil {
+			return err
 		}
-		deleteCmd := &DisposeCommand{}
-		cr.AddHandler(deleteCmd)
-		fmt.Println("Команда удаления добавлена")
+		fmt.Println("Данные с ключом", args[4], "удалены из коллекции", args[3])
 	case "get-data":
 		if len(args) < 2 {
-			return fmt.Errorf("недостаточно аргументов для команды get-data")
+			return notEnoughArguments("get-data")
+		}
+		if len(args) < 5 {
+			data, err := pools.GetPool(args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Println("Полученные данные:", data)
+			return nil
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
 		}
-		data, err := pools.GetPool(args[1])
+		value, err := collection.Get(args[4])
 		if err != nil {
 			return err
 		}
-		fmt.Println("Полученные данные:", data)
+		fmt.Println("Полученные данные:", value)
 	case "execute":
-		var dataExists bool
-		var data TData
-		data.Timestamp = time.Now()
-		cr.FirstHandler.Handle(&dataExists, &data, time.Now().Unix())
-		handleCommand(&data)
-		fmt.Println("Команды выполнены, текущее состояние:", data.Timestamp.Format("2006-01-02 15:04:05"))
-	case "save-state":
+		if len(args) < 5 {
+			return notEnoughArguments("execute")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		data, exists, err := collection.Replay(args[4], time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			fmt.Println("Команды выполнены, ключ", args[4], "не существует")
+			return nil
+		}
+		fmt.Println("Команды выполнены, текущее состояние:", data.Key, data.Value, data.Timestamp.Format("2006-01-02 15:04:05"))
+	case "get-data-at":
+		if len(args) < 6 {
+			return notEnoughArguments("get-data-at")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		timestamp, err := parseTimestamp(args[5])
+		if err != nil {
+			return err
+		}
+		data, err := collection.GetAt(args[4], timestamp)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Данные на", timestamp.Format(time.RFC3339Nano)+":", data.Key, data.Value)
+	case "get-range":
+		if len(args) < 6 {
+			return notEnoughArguments("get-range")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		query, err := ParseRangeQuery(args[4:])
+		if err != nil {
+			return err
+		}
+		result, err := collection.Range(query)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Найдено элементов:", len(result))
+		for _, data := range result {
+			fmt.Printf("  %s = %v\n", data.Key, data.Value)
+		}
+	case "check-collection":
+		if len(args) < 4 {
+			return notEnoughArguments("check-collection")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if err := collection.Validate(); err != nil {
+			return err
+		}
+		fmt.Println("Структура коллекции", args[3], "в порядке")
+	case "count-range":
+		if len(args) < 6 {
+			return notEnoughArguments("count-range")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		count, err := collection.Count(args[4], args[5])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Ключей в диапазоне:", count)
+	case "rank":
+		if len(args) < 5 {
+			return notEnoughArguments("rank")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		rank, err := collection.Rank(args[4])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Ключей меньше", args[4]+":", rank)
+	case "select":
+		if len(args) < 5 {
+			return notEnoughArguments("select")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		position, err := strconv.Atoi(args[4])
+		if err != nil {
+			return fmt.Errorf("%w: позиция должна быть числом: %s", ErrInvalidArgument, args[4])
+		}
+		data, err := collection.Select(position)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Ключ на позиции", position, "-", data.Key, data.Value)
+	case "get-range-at":
+		if len(args) < 7 {
+			return notEnoughArguments("get-range-at")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		timestamp, err := parseTimestamp(args[6])
+		if err != nil {
+			return err
+		}
+		result, err := collection.GetRangeAt(args[4], args[5], timestamp)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Данные на", timestamp.Format(time.RFC3339Nano)+":")
+		for _, data := range result {
+			fmt.Printf("  %s = %v\n", data.Key, data.Value)
+		}
+	case "history":
+		if len(args) < 5 {
+			return notEnoughArguments("history")
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if len(args) < 7 {
+			history, err := collection.History(args[4])
+			if err != nil {
+				return err
+			}
+			fmt.Println("История ключа", args[4]+":")
+			for _, entry := range history {
+				fmt.Printf("  %d. %s %s: %v -> %v\n", entry.Version, time.Unix(0, entry.DateTimeActivityStarted).Format(time.RFC3339Nano), entry.Command, entry.OldValue, entry.NewValue)
+			}
+			return nil
+		}
+		from, err := strconv.Atoi(args[5])
+		if err != nil {
+			return fmt.Errorf("%w: неверный номер версии %s", ErrInvalidArgument, args[5])
+		}
+		to, err := strconv.Atoi(args[6])
+		if err != nil {
+			return fmt.Errorf("%w: неверный номер версии %s", ErrInvalidArgument, args[6])
+		}
+		diff, err := collection.HistoryDiff(args[4], from, to)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Ключ %s, версии %d -> %d: %v -> %v, изменено: %t\n", diff.Key, from, to, diff.From.NewValue, diff.To.NewValue, diff.Changed)
+	case "begin":
+		if len(args) < 3 {
+			return notEnoughArguments("begin")
+		}
+		tx, err := pools.BeginTransaction(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Транзакция начата:", tx.ID)
+	case "tx":
+		if len(args) < 3 {
+			return notEnoughArguments("tx")
+		}
+		if err := pools.BufferOperation(args[1], args[2:]); err != nil {
+			return err
+		}
+		fmt.Println("Команда", args[2], "добавлена в транзакцию", args[1])
+	case "commit":
+		if len(args) < 2 {
+			return notEnoughArguments("commit")
+		}
+		if err := pools.CommitTransaction(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Транзакция", args[1], "зафиксирована")
+	case "rollback":
+		if len(args) < 2 {
+			return notEnoughArguments("rollback")
+		}
+		if err := pools.RollbackTransaction(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Транзакция", args[1], "отменена")
+	case "snapshot":
+		snapshot, err := pools.CreateSnapshot()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Снимок создан:", snapshot.ID, "версия", snapshot.Sequence)
+	case "release-snapshot":
 		if len(args) < 2 {
-			return fmt.Errorf("недостаточно аргументов для команды save-state")
+			return notEnoughArguments("release-snapshot")
+		}
+		if err := pools.ReleaseSnapshot(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Снимок", args[1], "освобожден")
+	case "snapshot-get":
+		if len(args) < 6 {
+			return notEnoughArguments("snapshot-get")
+		}
+		snapshot, err := pools.GetSnapshot(args[1])
+		if err != nil {
+			return err
+		}
+		collection, err := pools.GetCollection(args[2], args[3], args[4])
+		if err != nil {
+			return err
+		}
+		value, err := snapshot.Get(collection, args[5])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Данные снимка", snapshot.ID+":", value)
+	case "snapshot-get-range":
+		if len(args) < 7 {
+			return notEnoughArguments("snapshot-get-range")
 		}
-		err := pools.SaveToFile(args[1])
+		snapshot, err := pools.GetSnapshot(args[1])
 		if err != nil {
 			return err
 		}
+		collection, err := pools.GetCollection(args[2], args[3], args[4])
+		if err != nil {
+			return err
+		}
+		result, err := snapshot.GetRange(collection, args[5], args[6])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Данные снимка", snapshot.ID+":")
+		for _, data := range result {
+			fmt.Printf("  %s = %v\n", data.Key, data.Value)
+		}
+	case "gc-versions":
+		fmt.Println("Удалено версий:", pools.CollectVersions())
+	case "save-state":
+		if len(args) < 2 {
+			return notEnoughArguments("save-state")
+		}
+		if err := pools.SaveState(args[1]); err != nil {
+			return err
+		}
 		fmt.Println("Состояние системы успешно сохранено в файл:", args[1])
+	case "load-state":
+		if len(args) < 2 {
+			return notEnoughArguments("load-state")
+		}
+		err := pools.LoadFromFile(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Состояние системы успешно загружено из файла:", args[1])
+		pools.ShowAll()
+	case "save-collection", "load-collection":
+		if len(args) < 5 {
+			return notEnoughArguments(args[0])
+		}
+		collection, err := pools.GetCollection(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		if args[0] == "save-collection" {
+			if err := collection.SaveToFile(args[4]); err != nil {
+				return err
+			}
+			fmt.Println("Коллекция", args[3], "сохранена в файл:", args[4])
+		} else {
+			if err := collection.LoadFromFile(args[4]); err != nil {
+				return err
+			}
+			fmt.Println("Коллекция", args[3], "загружена из файла:", args[4])
+		}
+	case "save-schema":
+		if len(args) < 4 {
+			return notEnoughArguments("save-schema")
+		}
+		if err := pools.SaveSchema(args[1], args[2], args[3]); err != nil {
+			return err
+		}
+		fmt.Println("Схема", args[2], "сохранена в файл:", args[3])
+	case "load-schema":
+		if len(args) < 4 {
+			return notEnoughArguments("load-schema")
+		}
+		if err := pools.LoadSchema(args[1], args[2], args[3]); err != nil {
+			return err
+		}
+		fmt.Println("Схема", args[2], "загружена из файла:", args[3])
+	case "save-pool":
+		if len(args) < 3 {
+			return notEnoughArguments("save-pool")
+		}
+		if err := pools.SavePool(args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("Пул", args[1], "сохранен в файл:", args[2])
+	case "load-pool":
+		if len(args) < 3 {
+			return notEnoughArguments("load-pool")
+		}
+		if err := pools.LoadPool(args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("Пул", args[1], "загружен из файла:", args[2])
+	case "list-snapshots":
+		snapshots, err := pools.ListStateSnapshots()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Снимки состояния:")
+		for _, snapshot := range snapshots {
+			fmt.Printf("  %s  %s  %d байт\n", snapshot.ID, snapshot.Time.Local().Format(time.DateTime), snapshot.Size)
+		}
+	case "restore-snapshot":
+		if len(args) < 2 {
+			return notEnoughArguments("restore-snapshot")
+		}
+		if err := pools.RestoreStateSnapshot(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Состояние системы восстановлено из снимка:", args[1])
+		pools.ShowAll()
 	case "exit":
 		return nil
 	default:
-		return fmt.Errorf("неизвестная команда")
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, args[0])
 	}
 	return nil
 }
 
-func handleCommand(data *TData) {
-	data.Timestamp = time.Now()
-}
-
 var users = map[string]string{
 	"admin": "password1234",
 }
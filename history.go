@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// parseTimestamp reads RFC3339 or a Unix time. The unit of a Unix time is
+// told by its size: versions and history report nanoseconds, while people
+// usually type seconds or milliseconds, and up to the year 5000 each unit
+// stays below the next one's range.
+func parseTimestamp(value string) (time.Time, error) {
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		magnitude := number
+		if magnitude < 0 {
+			magnitude = -magnitude
+		}
+		switch {
+		case magnitude < 1e11:
+			return time.Unix(number, 0), nil
+		case magnitude < 1e14:
+			return time.UnixMilli(number), nil
+		case magnitude < 1e17:
+			return time.UnixMicro(number), nil
+		default:
+			return time.Unix(0, number), nil
+		}
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: неверный формат времени, ожидается unix-время или RFC3339", ErrInvalidArgument)
+	}
+	return timestamp, nil
+}
+
+func (tc *TreeManager) GetAt(key string, timestamp time.Time) (TData, error) {
+	data, exists, err := tc.Replay(key, timestamp.UnixNano())
+	if err != nil {
+		return TData{}, err
+	}
+	if !exists {
+		return TData{}, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return data, nil
+}
+
+func (tc *TreeManager) GetRangeAt(minValue, maxValue string, timestamp time.Time) ([]TData, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.chained() {
+		return nil, errNoHistory(tc.Type)
+	}
+
+	keys := make([]string, 0)
+	for key := range tc.Chains {
+		if key >= minValue && key <= maxValue {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]TData, 0, len(keys))
+	for _, key := range keys {
+		data, exists, err := tc.replay(key, timestamp.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			result = append(result, data)
+		}
+	}
+	return result, nil
+}
+
+type HistoryEntry struct {
+	Version                 int         `json:"version"`
+	Command                 string      `json:"command"`
+	DateTimeActivityStarted int64       `json:"dateTimeActivityStarted"`
+	Sequence                uint64      `json:"sequence"`
+	Exists                  bool        `json:"exists"`
+	OldValue                interface{} `json:"oldValue"`
+	NewValue                interface{} `json:"newValue"`
+}
+
+type HistoryDiff struct {
+	Key      string         `json:"key"`
+	From     HistoryEntry   `json:"from"`
+	To       HistoryEntry   `json:"to"`
+	Changed  bool           `json:"changed"`
+	Commands []HistoryEntry `json:"commands"`
+}
+
+func commandName(command Command) string {
+	switch command.(type) {
+	case *InsertCommand:
+		return "insert"
+	case *UpdateCommand:
+		return "update"
+	case *DisposeCommand:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// History lists every command applied to key, numbering them from 1 in the
+// order they were added to the key's chain. The numbers count the chain as it
+// is now: version collection folds the commands older than the retention
+// window into one insert, so after it runs the same command gets a smaller
+// number. Sequence does not change and identifies a command for good.
+func (tc *TreeManager) History(key string) ([]HistoryEntry, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.chained() {
+		return nil, errNoHistory(tc.Type)
+	}
+
+	cr, ok := tc.Chains[key]
+	if !ok || cr.FirstHandler == nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	var dataExists bool
+	var data TData
+	history := make([]HistoryEntry, 0)
+	for h := cr.FirstHandler; h != nil; h = h.NextHandler {
+		entry := HistoryEntry{
+			Version:                 len(history) + 1,
+			Command:                 commandName(h.Command),
+			DateTimeActivityStarted: h.DateTimeActivityStarted,
+			Sequence:                h.Sequence,
+		}
+		if dataExists {
+			entry.OldValue = data.Value
+		}
+		if err := h.Command.Execute(&dataExists, &data); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptedChain, err)
+		}
+		entry.Exists = dataExists
+		if dataExists {
+			entry.NewValue = data.Value
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+// HistoryDiff compares the state of key after version from with the state
+// after version to. Version 0 is the state before the first command; the
+// versions are History's, so they shift when old versions are collected.
+func (tc *TreeManager) HistoryDiff(key string, from, to int) (HistoryDiff, error) {
+	history, err := tc.History(key)
+	if err != nil {
+		return HistoryDiff{}, err
+	}
+	if from < 0 || to < 0 || from > len(history) || to > len(history) {
+		return HistoryDiff{}, fmt.Errorf("%w: версия должна быть от 0 до %d", ErrInvalidArgument, len(history))
+	}
+	if from > to {
+		from, to = to, from
+	}
+
+	versionState := func(version int) HistoryEntry {
+		if version == 0 {
+			return HistoryEntry{}
+		}
+		return history[version-1]
+	}
+	diff := HistoryDiff{
+		Key:      key,
+		From:     versionState(from),
+		To:       versionState(to),
+		Commands: history[from:to],
+	}
+	diff.Changed = diff.From.Exists != diff.To.Exists || !reflect.DeepEqual(diff.From.NewValue, diff.To.NewValue)
+	return diff, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"iter"
+	"sync"
+)
+
+// Iterator is a cursor over a tree in key order. A new iterator is not
+// positioned: Next moves it to the first key and Prev to the last. Stepping
+// past either end leaves it unpositioned again and returns false. Seek moves
+// to the first key not less than key. Key and Value are only valid after a
+// call that returned true.
+type Iterator interface {
+	Seek(key string) bool
+	Next() bool
+	Prev() bool
+	Key() string
+	Value() interface{}
+	Close()
+}
+
+// Iterable is anything that hands out iterators: every Tree and TreeManager.
+type Iterable interface {
+	NewIterator() Iterator
+}
+
+// Scan walks the keys of query in its order, honouring offset and limit, and
+// closes the iterator when the loop ends.
+func Scan(source Iterable, query RangeQuery) iter.Seq2[string, interface{}] {
+	return func(yield func(string, interface{}) bool) {
+		it := source.NewIterator()
+		defer it.Close()
+
+		var ok bool
+		step := it.Next
+		switch {
+		case query.Descending && query.HasMax:
+			step = it.Prev
+			// Nothing at or after Max means the scan starts at the last key.
+			if ok = it.Seek(query.Max); !ok {
+				ok = it.Prev()
+			}
+		case query.Descending:
+			step = it.Prev
+			ok = it.Prev()
+		case query.HasMin:
+			ok = it.Seek(query.Min)
+		default:
+			ok = it.Next()
+		}
+
+		skipped, count := 0, 0
+		for ; ok; ok = step() {
+			key := it.Key()
+			if query.Descending && query.aboveMax(key) || !query.Descending && query.belowMin(key) {
+				continue
+			}
+			if !query.Contains(key) {
+				return
+			}
+			if skipped < query.Offset {
+				skipped++
+				continue
+			}
+			if !yield(key, it.Value()) {
+				return
+			}
+			count++
+			if query.Limit > 0 && count >= query.Limit {
+				return
+			}
+		}
+	}
+}
+
+// lockedIterator keeps the collection read-locked until it is closed.
+type lockedIterator struct {
+	Iterator
+	once   sync.Once
+	unlock func()
+}
+
+func (it *lockedIterator) Close() {
+	it.Iterator.Close()
+	it.once.Do(it.unlock)
+}
+
+// NewIterator holds the collection's read lock until Close, so writers wait
+// for the iterator to be closed.
+func (tc *TreeManager) NewIterator() Iterator {
+	tree, unlock := tc.readTree()
+	return &lockedIterator{Iterator: tree.NewIterator(), unlock: unlock}
+}
+
+// The order-statistics helpers below serve engines without subtree sizes:
+// they cost O(log n + k) for k keys stepped over.
+
+func countByScan(source Iterable, minValue, maxValue string) (int, error) {
+	count := 0
+	for range Scan(source, RangeQuery{Min: minValue, Max: maxValue, HasMin: true, HasMax: true}) {
+		count++
+	}
+	return count, nil
+}
+
+func rankByScan(source Iterable, key string) (int, error) {
+	count := 0
+	for range Scan(source, RangeQuery{Max: key, HasMax: true, MaxExclusive: true}) {
+		count++
+	}
+	return count, nil
+}
+
+func selectByScan(source Iterable, position int) (KeyValue, error) {
+	if position >= 0 {
+		for key, value := range Scan(source, RangeQuery{Offset: position, Limit: 1}) {
+			return KeyValue{Key: key, Value: value}, nil
+		}
+	}
+	return KeyValue{}, positionNotFound(position)
+}
@@ -2,17 +2,89 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
 )
 
 func main() {
+	statePath := flag.String("load-state", "", "файл состояния, сохраненный командой save-state")
+	walPath := flag.String("wal", "", "файл журнала упреждающей записи; очищается при save-state в файл -load-state")
+	walSync := flag.String("wal-sync", "always", "политика fsync журнала: always, batched или none")
+	walInterval := flag.Duration("wal-sync-interval", time.Second, "период fsync журнала для политики batched")
+	retention := flag.Duration("version-retention", 24*time.Hour, "сколько хранить старые версии ключей, не закрепленные снимками; они удаляются каждые полсрока, но не чаще раза в минуту")
+	txTimeout := flag.Duration("transaction-timeout", 5*time.Minute, "через сколько простоя закрывать незавершенную транзакцию, 0 отключает")
+	snapshotDir := flag.String("snapshot-dir", "", "каталог автоматических снимков состояния; без него снимки не создаются")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "период снимков состояния, 0 отключает снимки по времени")
+	snapshotMutations := flag.Int64("snapshot-mutations", 1000, "снимок состояния после стольких изменений, 0 отключает")
+	snapshotKeep := flag.Int("snapshot-keep", 10, "сколько последних снимков состояния хранить")
+	snapshotKeepDays := flag.Int("snapshot-keep-days", 7, "за сколько последних дней хранить по одному снимку в день")
+	flag.Parse()
+
 	pools := NewPoolManager()
-	cr := &ChainOfResponsibility{}
+	pools.VersionRetention = *retention
+	pools.StatePath = *statePath
+	pools.Transactions.IdleTimeout = *txTimeout
+	if *statePath != "" {
+		if err := pools.LoadFromFile(*statePath); err != nil {
+			log.Fatalf("Ошибка загрузки состояния из %s: %v", *statePath, err)
+		}
+		fmt.Println("Состояние системы загружено из файла:", *statePath)
+	}
+	if *snapshotDir != "" {
+		snapshots, err := NewStateSnapshots(*snapshotDir, *snapshotInterval, *snapshotMutations, *snapshotKeep, *snapshotKeepDays)
+		if err != nil {
+			log.Fatalf("Ошибка открытия каталога снимков %s: %v", *snapshotDir, err)
+		}
+		pools.StateSnapshots = snapshots
+	}
+	if *walPath != "" {
+		policy, err := ParseWALSyncPolicy(*walSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wal, err := OpenWriteAheadLog(*walPath, policy, *walInterval)
+		if err != nil {
+			log.Fatalf("Ошибка открытия журнала %s: %v", *walPath, err)
+		}
+		replayed, err := wal.Replay(pools.LoadedSequence, pools.replayRecord)
+		if err != nil {
+			log.Fatalf("Ошибка повтора журнала %s: %v", *walPath, err)
+		}
+		fmt.Println("Повторено команд из журнала:", replayed)
+		pools.WAL = wal
+	}
+
+	// Disk collections write their cached pages and header only when closed,
+	// so they are closed before the process exits.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		pools.writeMu.Lock()
+		if err := pools.Close(); err != nil {
+			fmt.Println("Ошибка закрытия коллекций:", err)
+		}
+		if pools.WAL != nil {
+			if err := pools.WAL.Close(); err != nil {
+				fmt.Println("Ошибка закрытия журнала:", err)
+			}
+		}
+		os.Exit(0)
+	}()
+	if pools.StateSnapshots != nil {
+		go pools.RunStateSnapshots()
+	}
+	go pools.RunVersionCollection()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		file, err := os.Open("login.html")
@@ -73,27 +145,106 @@ func main() {
 	http.HandleFunc("/run-command", func(w http.ResponseWriter, r *http.Request) {
 		command := r.URL.Query().Get("command")
 		if command == "" {
-			http.Error(w, `{"error": "Missing command parameter"}`, http.StatusBadRequest)
+			writeError(w, fmt.Errorf("%w: не указан параметр command", ErrNotEnoughArguments))
 			return
 		}
-		if err := runCommand(pools, command, cr); err != nil {
-			http.Error(w, fmt.Sprintf(`{"error": "Error executing command: %s"}`, err), http.StatusInternalServerError)
+		if cookie, err := r.Cookie("transaction"); err == nil && cookie.Value != "" {
+			switch strings.SplitN(command, " ", 2)[0] {
+			case "insert-data", "update-data", "delete-data":
+				command = "tx " + cookie.Value + " " + command
+			}
+		}
+		if err := runCommand(pools, command); err != nil {
+			writeError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"message": "Command executed successfully"}`)
 	})
 
+	http.HandleFunc("/batch-insert", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Pool       string `json:"pool"`
+			Schema     string `json:"schema"`
+			Collection string `json:"collection"`
+			Pairs      []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"pairs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", ErrInvalidArgument, err))
+			return
+		}
+
+		// The batch goes through runCommand like any other command so that it
+		// is serialized with other writes and lands in the log. The command is
+		// split on whitespace, so every word has to be non-empty and free of
+		// it, or the pairs would shift.
+		args := []string{"batch-insert", request.Pool, request.Schema, request.Collection}
+		for _, pair := range request.Pairs {
+			args = append(args, pair.Key, pair.Value)
+		}
+		for _, arg := range args {
+			if arg == "" || strings.IndexFunc(arg, unicode.IsSpace) >= 0 {
+				writeError(w, fmt.Errorf("%w: имена, ключи и значения не должны быть пустыми или содержать пробелов: %q", ErrInvalidArgument, arg))
+				return
+			}
+		}
+		if err := runCommand(pools, strings.Join(args, " ")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"message": "Inserted %d pairs"}`, len(request.Pairs))
+	})
+
+	http.HandleFunc("/begin", func(w http.ResponseWriter, r *http.Request) {
+		tx, err := pools.BeginTransaction(r.URL.Query().Get("pool"), r.URL.Query().Get("schema"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:  "transaction",
+			Value: tx.ID,
+			Path:  "/",
+		})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"transaction": "%s"}`, tx.ID)
+	})
+
+	endTransaction := func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if cookie, err := r.Cookie("transaction"); id == "" && err == nil {
+			id = cookie.Value
+		}
+		var err error
+		if r.URL.Path == "/commit" {
+			err = pools.CommitTransaction(id)
+		} else {
+			err = pools.RollbackTransaction(id)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:   "transaction",
+			Path:   "/",
+			MaxAge: -1,
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"message": "Transaction %s finished"}`, id)
+	}
+	http.HandleFunc("/commit", endTransaction)
+	http.HandleFunc("/rollback", endTransaction)
+
 	http.HandleFunc("/get-info", func(w http.ResponseWriter, r *http.Request) {
 		type Info struct {
 			Pools map[string][]string `json:"pools"`
 		}
-		info := Info{Pools: make(map[string][]string)}
-		for poolName, pool := range pools.Pools {
-			for schemaName := range pool.Schemas {
-				info.Pools[poolName] = append(info.Pools[poolName], schemaName)
-			}
-		}
+		info := Info{Pools: pools.SchemaNames()}
 		data, err := json.Marshal(info)
 		if err != nil {
 			http.Error(w, fmt.Sprintf(`{"error": "Error getting info: %s"}`, err), http.StatusInternalServerError)
@@ -103,6 +254,173 @@ func main() {
 		w.Write(data)
 	})
 
+	getDataAt := func(w http.ResponseWriter, r *http.Request) {
+		type DataAt struct {
+			Key   string      `json:"key"`
+			Value interface{} `json:"value"`
+		}
+		query := r.URL.Query()
+		collection, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		timestamp, err := parseTimestamp(query.Get("timestamp"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var result interface{}
+		if r.URL.Path == "/get-data-at" {
+			data, err := collection.GetAt(query.Get("key"), timestamp)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			result = DataAt{Key: data.Key, Value: data.Value}
+		} else {
+			rangeData, err := collection.GetRangeAt(query.Get("min"), query.Get("max"), timestamp)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			items := make([]DataAt, 0, len(rangeData))
+			for _, data := range rangeData {
+				items = append(items, DataAt{Key: data.Key, Value: data.Value})
+			}
+			result = items
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "Error getting data: %s"}`, err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+	http.HandleFunc("/get-data-at", getDataAt)
+	http.HandleFunc("/get-range-at", getDataAt)
+
+	http.HandleFunc("/get-range", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		collection, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		args := []string{"-", "-"}
+		if query.Has("min") {
+			args[0] = query.Get("min")
+		}
+		if query.Has("max") {
+			args[1] = query.Get("max")
+		}
+		for _, name := range []string{"bounds", "limit", "offset", "order"} {
+			if query.Has(name) {
+				args = append(args, name+"="+query.Get(name))
+			}
+		}
+		rangeQuery, err := ParseRangeQuery(args)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		type Pair struct {
+			Key   string      `json:"key"`
+			Value interface{} `json:"value"`
+		}
+
+		// Pairs are written batch by batch instead of being collected first,
+		// so the response size does not cost memory, and the collection is
+		// not locked while a slow client reads a batch. The status goes out
+		// with the first batch, so an error reading it is still reported; a
+		// later one can only abort the response, which leaves the client an
+		// unfinished array instead of a shorter valid one.
+		started, first := false, true
+		var encodeErr error
+		start := func() {
+			if !started {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("["))
+				started = true
+			}
+		}
+		err = collection.RangeBatches(rangeQuery, func(pairs []KeyValue) bool {
+			for _, pair := range pairs {
+				data, err := json.Marshal(Pair{Key: pair.Key, Value: pair.Value})
+				if err != nil {
+					encodeErr = fmt.Errorf("ключ %s: %w", pair.Key, err)
+					return false
+				}
+				start()
+				if !first {
+					w.Write([]byte(","))
+				}
+				first = false
+				if _, err := w.Write(data); err != nil {
+					return false
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = encodeErr
+		}
+		if err != nil {
+			if !started {
+				writeError(w, err)
+				return
+			}
+			log.Println("Ошибка чтения диапазона:", err)
+			panic(http.ErrAbortHandler)
+		}
+		start()
+		w.Write([]byte("]"))
+	})
+
+	http.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		collection, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var result interface{}
+		if query.Has("from") || query.Has("to") {
+			from, errFrom := strconv.Atoi(query.Get("from"))
+			to, errTo := strconv.Atoi(query.Get("to"))
+			if errFrom != nil || errTo != nil {
+				writeError(w, fmt.Errorf("%w: неверный номер версии", ErrInvalidArgument))
+				return
+			}
+			diff, err := collection.HistoryDiff(query.Get("key"), from, to)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			result = diff
+		} else {
+			history, err := collection.History(query.Get("key"))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			result = history
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "Error getting history: %s"}`, err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+
 	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			file, err := os.Open("registration.html")
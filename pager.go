@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	pageSize  = 4096
+	pageMagic = "DBPAGES1"
+)
+
+// Pager reads and writes fixed-size pages of one file. Page 0 is the header:
+// magic, page size, root page and page count; every other page is a node.
+type Pager struct {
+	file      *os.File
+	Root      uint32
+	PageCount uint32
+}
+
+func OpenPager(path string) (*Pager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pager{file: file}
+
+	header := make([]byte, pageSize)
+	_, err = file.ReadAt(header, 0)
+	switch {
+	case errors.Is(err, io.EOF) || err == nil && isZeroPage(header):
+		// A new file, or one whose header was never written: the header
+		// goes out right away, so a crash before the first flush leaves a
+		// file that opens as empty instead of one that cannot be opened.
+		// The tree allocates its root.
+		p.PageCount = 1
+		if err := p.Sync(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	case err != nil:
+		file.Close()
+		return nil, err
+	default:
+		if string(header[:8]) != pageMagic || binary.LittleEndian.Uint32(header[8:]) != pageSize {
+			file.Close()
+			return nil, fmt.Errorf("%w: %s не является файлом страниц", ErrInvalidArgument, path)
+		}
+		p.Root = binary.LittleEndian.Uint32(header[12:])
+		p.PageCount = binary.LittleEndian.Uint32(header[16:])
+	}
+	return p, nil
+}
+
+func isZeroPage(page []byte) bool {
+	for _, b := range page {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Pager) ReadPage(id uint32, page []byte) error {
+	_, err := p.file.ReadAt(page[:pageSize], int64(id)*pageSize)
+	return err
+}
+
+func (p *Pager) WritePage(id uint32, page []byte) error {
+	_, err := p.file.WriteAt(page[:pageSize], int64(id)*pageSize)
+	return err
+}
+
+func (p *Pager) Allocate() uint32 {
+	id := p.PageCount
+	p.PageCount++
+	return id
+}
+
+// Reset drops every page but the header, which is rewritten to describe an
+// empty file.
+func (p *Pager) Reset() error {
+	if err := p.file.Truncate(pageSize); err != nil {
+		return err
+	}
+	p.Root, p.PageCount = 0, 1
+	return p.Sync()
+}
+
+// Sync writes the header and flushes the file to disk.
+func (p *Pager) Sync() error {
+	header := make([]byte, pageSize)
+	copy(header, pageMagic)
+	binary.LittleEndian.PutUint32(header[8:], pageSize)
+	binary.LittleEndian.PutUint32(header[12:], p.Root)
+	binary.LittleEndian.PutUint32(header[16:], p.PageCount)
+	if err := p.WritePage(0, header); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+func (p *Pager) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RangeQuery describes a key range scan. A bound that is not set leaves that
+// side of the range open; Limit 0 means no limit.
+type RangeQuery struct {
+	Min          string
+	Max          string
+	HasMin       bool
+	HasMax       bool
+	MinExclusive bool
+	MaxExclusive bool
+	Offset       int
+	Limit        int
+	Descending   bool
+}
+
+// ParseRangeQuery reads "<min> <max> [bounds=[)] [limit=N] [offset=N] [order=desc]".
+// A bound given as "-" is open.
+func ParseRangeQuery(args []string) (RangeQuery, error) {
+	var query RangeQuery
+	if len(args) < 2 {
+		return query, fmt.Errorf("%w: нужны нижняя и верхняя границы диапазона", ErrNotEnoughArguments)
+	}
+	if args[0] != "-" {
+		query.Min, query.HasMin = args[0], true
+	}
+	if args[1] != "-" {
+		query.Max, query.HasMax = args[1], true
+	}
+	for _, arg := range args[2:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return query, fmt.Errorf("%w: ожидается параметр вида имя=значение: %s", ErrInvalidArgument, arg)
+		}
+		if err := query.set(name, value); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+func (q *RangeQuery) set(name, value string) error {
+	switch name {
+	case "bounds":
+		if len(value) != 2 || !strings.ContainsRune("[(", rune(value[0])) || !strings.ContainsRune("])", rune(value[1])) {
+			return fmt.Errorf("%w: границы задаются как [], [), (] или (): %s", ErrInvalidArgument, value)
+		}
+		q.MinExclusive = value[0] == '('
+		q.MaxExclusive = value[1] == ')'
+	case "limit", "offset":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("%w: %s должен быть неотрицательным числом: %s", ErrInvalidArgument, name, value)
+		}
+		if name == "limit" {
+			q.Limit = number
+		} else {
+			q.Offset = number
+		}
+	case "order":
+		if value != "asc" && value != "desc" {
+			return fmt.Errorf("%w: order должен быть asc или desc: %s", ErrInvalidArgument, value)
+		}
+		q.Descending = value == "desc"
+	default:
+		return fmt.Errorf("%w: неизвестный параметр диапазона: %s", ErrInvalidArgument, name)
+	}
+	return nil
+}
+
+// belowMin reports whether key lies before the lower bound.
+func (q RangeQuery) belowMin(key string) bool {
+	if !q.HasMin {
+		return false
+	}
+	return key < q.Min || (q.MinExclusive && key == q.Min)
+}
+
+// aboveMax reports whether key lies after the upper bound.
+func (q RangeQuery) aboveMax(key string) bool {
+	if !q.HasMax {
+		return false
+	}
+	return key > q.Max || (q.MaxExclusive && key == q.Max)
+}
+
+// hasLess reports whether the range can hold keys smaller than key, i.e.
+// whether a scan has to look to the left of it.
+func (q RangeQuery) hasLess(key string) bool {
+	return !q.HasMin || key > q.Min
+}
+
+// hasGreater reports whether the range can hold keys greater than key.
+func (q RangeQuery) hasGreater(key string) bool {
+	return !q.HasMax || key < q.Max
+}
+
+func (q RangeQuery) Contains(key string) bool {
+	return !q.belowMin(key) && !q.aboveMax(key)
+}
+
+// rangeCollector applies offset and limit to the keys an engine visits in
+// scan order. add returns false once the limit is reached.
+type rangeCollector struct {
+	query   RangeQuery
+	skipped int
+	result  []KeyValue
+}
+
+func newRangeCollector(query RangeQuery) *rangeCollector {
+	return &rangeCollector{query: query, result: make([]KeyValue, 0)}
+}
+
+func (c *rangeCollector) add(key string, value interface{}) bool {
+	if c.done() {
+		return false
+	}
+	if c.skipped < c.query.Offset {
+		c.skipped++
+		return true
+	}
+	c.result = append(c.result, KeyValue{Key: key, Value: value})
+	return !c.done()
+}
+
+func (c *rangeCollector) done() bool {
+	return c.query.Limit > 0 && len(c.result) >= c.query.Limit
+}
+
+// rangeBatchSize is how many pairs RangeBatches reads per read lock.
+const rangeBatchSize = 1024
+
+// RangeBatches hands the pairs of query to fn in batches. Each batch is read
+// under its own short read lock and the next one resumes after the last key
+// handed out, the way Convert copies a collection, so a slow consumer never
+// keeps writers waiting. Keys written between batches may or may not be seen.
+// fn returns false to stop early.
+func (tc *TreeManager) RangeBatches(query RangeQuery, fn func(pairs []KeyValue) bool) error {
+	for {
+		batch := query
+		if batch.Limit == 0 || batch.Limit > rangeBatchSize {
+			batch.Limit = rangeBatchSize
+		}
+		pairs, err := tc.Range(batch)
+		if err != nil {
+			return err
+		}
+		if len(pairs) == 0 || !fn(pairs) || len(pairs) < batch.Limit {
+			return nil
+		}
+		if query.Limit > 0 {
+			if query.Limit -= len(pairs); query.Limit == 0 {
+				return nil
+			}
+		}
+		last := pairs[len(pairs)-1].Key
+		query.Offset = 0
+		if query.Descending {
+			query.Max, query.HasMax, query.MaxExclusive = last, true, true
+		} else {
+			query.Min, query.HasMin, query.MinExclusive = last, true, true
+		}
+	}
+}
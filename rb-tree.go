@@ -1,10 +1,6 @@
 package main
 
-import (
-	"encoding/json"
-	"fmt"
-	"os"
-)
+import "math/bits"
 
 type Color int
 
@@ -17,6 +13,7 @@ type NodeRB struct {
 	Key        string
 	Value      interface{}
 	Color      Color
+	Size       int
 	LeftChild  *NodeRB
 	RightChild *NodeRB
 	Parent     *NodeRB
@@ -31,6 +28,9 @@ func NewRedBlackTree() *RedBlackTree {
 }
 
 func (tree *RedBlackTree) Insert(key string, value interface{}) error {
+	if tree.searchRB(tree.Root, key) != nil {
+		return ErrKeyExists
+	}
 	tree.insertRB(key, value)
 	return nil
 }
@@ -38,7 +38,7 @@ func (tree *RedBlackTree) Insert(key string, value interface{}) error {
 func (tree *RedBlackTree) Get(key string) (interface{}, error) {
 	node := tree.searchRB(tree.Root, key)
 	if node == nil {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
 	}
 	return node.Value, nil
 }
@@ -64,6 +64,155 @@ func (tree *RedBlackTree) GetRange(minValue, maxValue string) ([]string, error)
 	return result, nil
 }
 
+func (tree *RedBlackTree) Range(query RangeQuery) ([]KeyValue, error) {
+	collector := newRangeCollector(query)
+	var rangeHelper func(node *NodeRB) bool
+	rangeHelper = func(node *NodeRB) bool {
+		if node == nil {
+			return true
+		}
+		first, second := node.LeftChild, node.RightChild
+		goFirst, goSecond := query.hasLess(node.Key), query.hasGreater(node.Key)
+		if query.Descending {
+			first, second = second, first
+			goFirst, goSecond = goSecond, goFirst
+		}
+		if goFirst && !rangeHelper(first) {
+			return false
+		}
+		if query.Contains(node.Key) && !collector.add(node.Key, node.Value) {
+			return false
+		}
+		return !goSecond || rangeHelper(second)
+	}
+	rangeHelper(tree.Root)
+	return collector.result, nil
+}
+
+// redBlackIterator keeps the path from the root to the current node.
+type redBlackIterator struct {
+	tree *RedBlackTree
+	path []*NodeRB
+}
+
+func (tree *RedBlackTree) NewIterator() Iterator {
+	return &redBlackIterator{tree: tree}
+}
+
+func (it *redBlackIterator) Seek(key string) bool {
+	it.path = it.path[:0]
+	found := -1
+	for node := it.tree.Root; node != nil; {
+		it.path = append(it.path, node)
+		if key == node.Key {
+			return true
+		}
+		if key < node.Key {
+			found = len(it.path) - 1
+			node = node.LeftChild
+		} else {
+			node = node.RightChild
+		}
+	}
+	it.path = it.path[:found+1]
+	return found >= 0
+}
+
+func (it *redBlackIterator) descend(node *NodeRB, toLeft bool) {
+	for node != nil {
+		it.path = append(it.path, node)
+		if toLeft {
+			node = node.LeftChild
+		} else {
+			node = node.RightChild
+		}
+	}
+}
+
+func (it *redBlackIterator) Next() bool {
+	if len(it.path) == 0 {
+		it.descend(it.tree.Root, true)
+		return len(it.path) > 0
+	}
+	if right := it.path[len(it.path)-1].RightChild; right != nil {
+		it.descend(right, true)
+		return true
+	}
+	for {
+		child := it.path[len(it.path)-1]
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) == 0 {
+			return false
+		}
+		if it.path[len(it.path)-1].LeftChild == child {
+			return true
+		}
+	}
+}
+
+func (it *redBlackIterator) Prev() bool {
+	if len(it.path) == 0 {
+		it.descend(it.tree.Root, false)
+		return len(it.path) > 0
+	}
+	if left := it.path[len(it.path)-1].LeftChild; left != nil {
+		it.descend(left, false)
+		return true
+	}
+	for {
+		child := it.path[len(it.path)-1]
+		it.path = it.path[:len(it.path)-1]
+		if len(it.path) == 0 {
+			return false
+		}
+		if it.path[len(it.path)-1].RightChild == child {
+			return true
+		}
+	}
+}
+
+func (it *redBlackIterator) Key() string {
+	return it.path[len(it.path)-1].Key
+}
+
+func (it *redBlackIterator) Value() interface{} {
+	return it.path[len(it.path)-1].Value
+}
+
+func (it *redBlackIterator) Close() {
+	it.path = nil
+}
+
+func (tree *RedBlackTree) Count(minValue, maxValue string) (int, error) {
+	if minValue > maxValue {
+		return 0, nil
+	}
+	return countLessRB(tree.Root, maxValue, true) - countLessRB(tree.Root, minValue, false), nil
+}
+
+func (tree *RedBlackTree) Rank(key string) (int, error) {
+	return countLessRB(tree.Root, key, false), nil
+}
+
+func (tree *RedBlackTree) Select(position int) (KeyValue, error) {
+	if position < 0 || position >= sizeRB(tree.Root) {
+		return KeyValue{}, positionNotFound(position)
+	}
+	node := tree.Root
+	for {
+		left := sizeRB(node.LeftChild)
+		switch {
+		case position < left:
+			node = node.LeftChild
+		case position > left:
+			position -= left + 1
+			node = node.RightChild
+		default:
+			return KeyValue{Key: node.Key, Value: node.Value}, nil
+		}
+	}
+}
+
 func (tree *RedBlackTree) Update(key string, value interface{}) error {
 	node, err := getNodeRB(tree.Root, key)
 	if err != nil {
@@ -74,29 +223,57 @@ func (tree *RedBlackTree) Update(key string, value interface{}) error {
 }
 
 func (tree *RedBlackTree) Remove(key string) error {
+	if tree.searchRB(tree.Root, key) == nil {
+		return ErrKeyNotFound
+	}
 	tree.deleteRB(key)
 	return nil
 }
 
-func (tree *RedBlackTree) SaveToFile(filename string) error {
-	data, err := json.Marshal(tree)
-	if err != nil {
-		return err
+func (tree *RedBlackTree) Walk(fn func(key string, value interface{})) {
+	var walkHelper func(node *NodeRB)
+	walkHelper = func(node *NodeRB) {
+		if node == nil {
+			return
+		}
+		walkHelper(node.LeftChild)
+		fn(node.Key, node.Value)
+		walkHelper(node.RightChild)
 	}
-	return os.WriteFile(filename, data, 0644)
+	walkHelper(tree.Root)
+}
+
+func (tree *RedBlackTree) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "redblack"}, tree)
 }
 
 func (tree *RedBlackTree) LoadFromFile(filename string) error {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return err
+	return loadTreeFileInto(filename, tree)
+}
+
+func sizeRB(node *NodeRB) int {
+	if node == nil {
+		return 0
 	}
-	return json.Unmarshal(data, tree)
+	return node.Size
+}
+
+func countLessRB(node *NodeRB, key string, inclusive bool) int {
+	count := 0
+	for node != nil {
+		if node.Key < key || inclusive && node.Key == key {
+			count += sizeRB(node.LeftChild) + 1
+			node = node.RightChild
+		} else {
+			node = node.LeftChild
+		}
+	}
+	return count
 }
 
 func getNodeRB(root *NodeRB, key string) (*NodeRB, error) {
 	if root == nil {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
 	}
 	if key < root.Key {
 		return getNodeRB(root.LeftChild, key)
@@ -112,6 +289,7 @@ func (tree *RedBlackTree) insertRB(key string, value interface{}) {
 		Key:        key,
 		Value:      value,
 		Color:      RED,
+		Size:       1,
 		LeftChild:  nil,
 		RightChild: nil,
 		Parent:     nil,
@@ -120,11 +298,13 @@ func (tree *RedBlackTree) insertRB(key string, value interface{}) {
 		tree.Root = newNode
 	} else {
 		tree.insertNodeRB(tree.Root, newNode)
-		tree.fixInsertionRB(newNode)
 	}
+	// The fix-up also runs for the first node: it is what turns the root black.
+	tree.fixInsertionRB(newNode)
 }
 
 func (tree *RedBlackTree) insertNodeRB(root, newNode *NodeRB) {
+	root.Size++
 	if newNode.Key < root.Key {
 		if root.LeftChild == nil {
 			root.LeftChild = newNode
@@ -162,6 +342,8 @@ func (tree *RedBlackTree) rotateLeftRB(node *NodeRB) {
 	}
 	rightChild.LeftChild = node
 	node.Parent = rightChild
+	node.Size = sizeRB(node.LeftChild) + sizeRB(node.RightChild) + 1
+	rightChild.Size = node.Size + sizeRB(rightChild.RightChild) + 1
 }
 
 func (tree *RedBlackTree) rotateRightRB(node *NodeRB) {
@@ -184,6 +366,8 @@ func (tree *RedBlackTree) rotateRightRB(node *NodeRB) {
 	}
 	leftChild.RightChild = node
 	node.Parent = leftChild
+	node.Size = sizeRB(node.LeftChild) + sizeRB(node.RightChild) + 1
+	leftChild.Size = sizeRB(leftChild.LeftChild) + node.Size + 1
 }
 
 func (tree *RedBlackTree) fixInsertionRB(node *NodeRB) {
@@ -238,33 +422,46 @@ func (tree *RedBlackTree) deleteRB(key string) {
 		child = tree.successor(nodeToDelete)
 	}
 
-	var replacement *NodeRB
-	if child.LeftChild != nil {
-		replacement = child.LeftChild
+	replacement, parent := tree.spliceOutRB(child)
+	if child != nodeToDelete {
+		nodeToDelete.Key = child.Key
+		nodeToDelete.Value = child.Value
+	}
+
+	// Removing a black node leaves its side one black short even when
+	// nothing took its place, so the fix-up runs for a nil replacement too.
+	if child.Color == BLACK {
+		tree.fixDeletionRB(replacement, parent)
+	}
+}
+
+// spliceOutRB unlinks node, which has at most one child, and puts that child
+// in its place. It returns the child, possibly nil, and node's old parent,
+// which the fix-up needs because a nil child cannot point to it.
+func (tree *RedBlackTree) spliceOutRB(node *NodeRB) (replacement, parent *NodeRB) {
+	if node.LeftChild != nil {
+		replacement = node.LeftChild
 	} else {
-		replacement = child.RightChild
+		replacement = node.RightChild
 	}
 
+	parent = node.Parent
 	if replacement != nil {
-		replacement.Parent = child.Parent
+		replacement.Parent = parent
 	}
 
-	if child.Parent == nil {
+	if parent == nil {
 		tree.Root = replacement
-	} else if child == child.Parent.LeftChild {
-		child.Parent.LeftChild = replacement
+	} else if node == parent.LeftChild {
+		parent.LeftChild = replacement
 	} else {
-		child.Parent.RightChild = replacement
+		parent.RightChild = replacement
 	}
 
-	if child != nodeToDelete {
-		nodeToDelete.Key = child.Key
-		nodeToDelete.Value = child.Value
-	}
-
-	if child.Color == BLACK && replacement != nil {
-		tree.fixDeletionRB(replacement)
+	for ancestor := parent; ancestor != nil; ancestor = ancestor.Parent {
+		ancestor.Size--
 	}
+	return replacement, parent
 }
 
 func (tree *RedBlackTree) searchRB(node *NodeRB, key string) *NodeRB {
@@ -298,54 +495,69 @@ func (tree *RedBlackTree) minimum(node *NodeRB) *NodeRB {
 	return node
 }
 
-func (tree *RedBlackTree) fixDeletionRB(node *NodeRB) {
-	for node != nil && node != tree.Root && node.Color == BLACK {
-		if node == node.Parent.LeftChild {
-			sibling := node.Parent.RightChild
-			if sibling.Color == RED {
+// colorRB treats nil leaves as black.
+func colorRB(node *NodeRB) Color {
+	if node == nil {
+		return BLACK
+	}
+	return node.Color
+}
+
+// fixDeletionRB restores the colour rules after a black node was removed
+// from under parent; node is what took its place and may be nil. A nil node
+// is taken for the left child when both sides of parent are empty, which
+// cannot mislead: a removed black leaf always has a non-nil sibling, since
+// that side had the same black height.
+func (tree *RedBlackTree) fixDeletionRB(node, parent *NodeRB) {
+	for node != tree.Root && colorRB(node) == BLACK {
+		if node == parent.LeftChild {
+			sibling := parent.RightChild
+			if colorRB(sibling) == RED {
 				sibling.Color = BLACK
-				node.Parent.Color = RED
-				tree.rotateLeftRB(node.Parent)
-				sibling = node.Parent.RightChild
+				parent.Color = RED
+				tree.rotateLeftRB(parent)
+				sibling = parent.RightChild
 			}
-			if sibling.LeftChild.Color == BLACK && sibling.RightChild.Color == BLACK {
+			if colorRB(sibling.LeftChild) == BLACK && colorRB(sibling.RightChild) == BLACK {
 				sibling.Color = RED
-				node = node.Parent
+				node = parent
+				parent = node.Parent
 			} else {
-				if sibling.RightChild.Color == BLACK {
+				if colorRB(sibling.RightChild) == BLACK {
 					sibling.LeftChild.Color = BLACK
 					sibling.Color = RED
 					tree.rotateRightRB(sibling)
-					sibling = node.Parent.RightChild
+					sibling = parent.RightChild
 				}
-				sibling.Color = node.Parent.Color
-				node.Parent.Color = BLACK
+				sibling.Color = parent.Color
+				parent.Color = BLACK
 				sibling.RightChild.Color = BLACK
-				tree.rotateLeftRB(node.Parent)
+				tree.rotateLeftRB(parent)
 				node = tree.Root
 			}
 		} else {
-			sibling := node.Parent.LeftChild
-			if sibling.Color == RED {
+			sibling := parent.LeftChild
+			if colorRB(sibling) == RED {
 				sibling.Color = BLACK
-				node.Parent.Color = RED
-				tree.rotateRightRB(node.Parent)
-				sibling = node.Parent.LeftChild
+				parent.Color = RED
+				tree.rotateRightRB(parent)
+				sibling = parent.LeftChild
 			}
-			if sibling.RightChild.Color == BLACK && sibling.LeftChild.Color == BLACK {
+			if colorRB(sibling.RightChild) == BLACK && colorRB(sibling.LeftChild) == BLACK {
 				sibling.Color = RED
-				node = node.Parent
+				node = parent
+				parent = node.Parent
 			} else {
-				if sibling.LeftChild.Color == BLACK {
+				if colorRB(sibling.LeftChild) == BLACK {
 					sibling.RightChild.Color = BLACK
 					sibling.Color = RED
 					tree.rotateLeftRB(sibling)
-					sibling = node.Parent.LeftChild
+					sibling = parent.LeftChild
 				}
-				sibling.Color = node.Parent.Color
-				node.Parent.Color = BLACK
+				sibling.Color = parent.Color
+				parent.Color = BLACK
 				sibling.LeftChild.Color = BLACK
-				tree.rotateRightRB(node.Parent)
+				tree.rotateRightRB(parent)
 				node = tree.Root
 			}
 		}
@@ -355,6 +567,87 @@ func (tree *RedBlackTree) fixDeletionRB(node *NodeRB) {
 	}
 }
 
+// BulkLoad replaces the tree with a balanced one built from sorted pairs in
+// O(n). Every level but the deepest is complete, so colouring the deepest
+// level red and the rest black gives one black height everywhere.
+func (tree *RedBlackTree) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
+		return err
+	}
+	tree.Root = buildRB(pairs, nil, 0, bits.Len(uint(len(pairs)))-1)
+	return nil
+}
+
+func buildRB(pairs []KeyValue, parent *NodeRB, depth, redDepth int) *NodeRB {
+	if len(pairs) == 0 {
+		return nil
+	}
+	mid := len(pairs) / 2
+	node := &NodeRB{Key: pairs[mid].Key, Value: pairs[mid].Value, Color: BLACK, Size: len(pairs), Parent: parent}
+	if depth == redDepth && depth > 0 {
+		node.Color = RED
+	}
+	node.LeftChild = buildRB(pairs[:mid], node, depth+1, redDepth)
+	node.RightChild = buildRB(pairs[mid+1:], node, depth+1, redDepth)
+	return node
+}
+
+// Validate checks key order, parent links, subtree sizes and the colour
+// rules: a black root, no red node with a red child and one black height.
+func (tree *RedBlackTree) Validate() error {
+	if tree.Root == nil {
+		return nil
+	}
+	if tree.Root.Parent != nil {
+		return corruptedAt("root", "у корня есть родитель")
+	}
+	if tree.Root.Color != BLACK {
+		return corruptedAt("root", "корень красный")
+	}
+	_, err := validateRB(tree.Root, "root", nil, nil)
+	return err
+}
+
+// validateRB returns the black height of node's subtree.
+func validateRB(node *NodeRB, path string, low, high *string) (int, error) {
+	if node == nil {
+		return 1, nil
+	}
+	if low != nil && node.Key <= *low || high != nil && node.Key >= *high {
+		return 0, corruptedAt(path, "ключ %s нарушает порядок", node.Key)
+	}
+	for _, child := range []*NodeRB{node.LeftChild, node.RightChild} {
+		if child == nil {
+			continue
+		}
+		if child.Parent != node {
+			return 0, corruptedAt(path, "у потомка %s неверный Parent", child.Key)
+		}
+		if node.Color == RED && child.Color == RED {
+			return 0, corruptedAt(path, "у красного узла красный потомок %s", child.Key)
+		}
+	}
+
+	left, err := validateRB(node.LeftChild, path+".L", low, &node.Key)
+	if err != nil {
+		return 0, err
+	}
+	right, err := validateRB(node.RightChild, path+".R", &node.Key, high)
+	if err != nil {
+		return 0, err
+	}
+	if left != right {
+		return 0, corruptedAt(path, "черная высота слева %d, справа %d", left, right)
+	}
+	if expected := sizeRB(node.LeftChild) + sizeRB(node.RightChild) + 1; node.Size != expected {
+		return 0, corruptedAt(path, "размер поддерева %d, ожидался %d", node.Size, expected)
+	}
+	if node.Color == BLACK {
+		left++
+	}
+	return left, nil
+}
+
 type RedBlackCollection struct {
 	Tree *RedBlackTree
 }
@@ -386,17 +679,9 @@ func (rb *RedBlackCollection) Remove(key string) error {
 }
 
 func (rb *RedBlackCollection) SaveToFile(filename string) error {
-	data, err := json.Marshal(rb)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(filename, data, 0644)
+	return rb.Tree.SaveToFile(filename)
 }
 
 func (rb *RedBlackCollection) LoadFromFile(filename string) error {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, rb)
+	return rb.Tree.LoadFromFile(filename)
 }
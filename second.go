@@ -2,11 +2,12 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
 type Command interface {
-	Execute(dataExists *bool, dataToModify *TData)
+	Execute(dataExists *bool, dataToModify *TData) error
 }
 
 type TData struct {
@@ -19,52 +20,88 @@ type InsertCommand struct {
 	InitialVersion TData
 }
 
-func (c *InsertCommand) Execute(dataExists *bool, dataToModify *TData) {
+func (c *InsertCommand) Execute(dataExists *bool, dataToModify *TData) error {
 	if *dataExists {
-		panic("attempt to insert already existent data")
+		return fmt.Errorf("%w: %s", ErrKeyExists, c.InitialVersion.Key)
 	}
 	*dataToModify = c.InitialVersion
 	*dataExists = true
 	fmt.Printf("Вставка данных: ключ = %s, значение = %v, время = %s\n", dataToModify.Key, dataToModify.Value, time.Now().Format(time.RFC3339))
+	return nil
 }
 
 type UpdateCommand struct {
 	UpdateExpression string
 }
 
-func (c *UpdateCommand) Execute(dataExists *bool, dataToModify *TData) {
+func (c *UpdateCommand) Execute(dataExists *bool, dataToModify *TData) error {
 	if !*dataExists {
-		panic("attempt to modify non-existent data")
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, dataToModify.Key)
 	}
 	dataToModify.Value = c.UpdateExpression
 	dataToModify.Timestamp = time.Now()
 	fmt.Printf("Обновление данных: ключ = %s, новое значение = %v, время = %s\n", dataToModify.Key, dataToModify.Value, dataToModify.Timestamp.Format(time.RFC3339))
+	return nil
 }
 
 type DisposeCommand struct{}
 
-func (c *DisposeCommand) Execute(dataExists *bool, dataToModify *TData) {
+func (c *DisposeCommand) Execute(dataExists *bool, dataToModify *TData) error {
 	if !*dataExists {
-		panic("attempt to dispose non-existent data")
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, dataToModify.Key)
 	}
 	*dataExists = false
 	fmt.Printf("Удаление данных: ключ = %s, время = %s\n", dataToModify.Key, time.Now().Format(time.RFC3339))
+	return nil
+}
+
+var (
+	versionMu     sync.Mutex
+	lastTimestamp int64
+	lastSequence  uint64
+)
+
+// nextVersion returns a nanosecond timestamp that is strictly greater than any
+// previously returned one, even if the wall clock stalls or goes backwards,
+// together with a global sequence number.
+func nextVersion() (int64, uint64) {
+	versionMu.Lock()
+	defer versionMu.Unlock()
+
+	timestamp := time.Now().UnixNano()
+	if timestamp <= lastTimestamp {
+		timestamp = lastTimestamp + 1
+	}
+	lastTimestamp = timestamp
+	lastSequence++
+	return timestamp, lastSequence
+}
+
+func currentVersion() (int64, uint64) {
+	versionMu.Lock()
+	defer versionMu.Unlock()
+	return lastTimestamp, lastSequence
 }
 
 type ChainOfResponsibilityHandler struct {
 	Command                 Command
 	DateTimeActivityStarted int64
+	Sequence                uint64
 	NextHandler             *ChainOfResponsibilityHandler
 }
 
-func (h *ChainOfResponsibilityHandler) Handle(dataExists *bool, dataToModify *TData, dateTimeTarget int64) {
-	if dateTimeTarget <= h.DateTimeActivityStarted {
-		return
+func (h *ChainOfResponsibilityHandler) Handle(dataExists *bool, dataToModify *TData, dateTimeTarget int64) error {
+	if dateTimeTarget < h.DateTimeActivityStarted {
+		return nil
+	}
+	if err := h.Command.Execute(dataExists, dataToModify); err != nil {
+		return err
 	}
-	h.Command.Execute(dataExists, dataToModify)
+	dataToModify.Timestamp = time.Unix(0, h.DateTimeActivityStarted)
 	if h.NextHandler != nil {
-		h.NextHandler.Handle(dataExists, dataToModify, dateTimeTarget)
+		return h.NextHandler.Handle(dataExists, dataToModify, dateTimeTarget)
 	}
+	return nil
 }
 
 type ChainOfResponsibility struct {
@@ -73,10 +110,11 @@ type ChainOfResponsibility struct {
 }
 
 func (c *ChainOfResponsibility) AddHandler(command Command) {
-	dateTimeActivityStarted := time.Now().Unix()
+	dateTimeActivityStarted, sequence := nextVersion()
 	addedHandler := &ChainOfResponsibilityHandler{
 		Command:                 command,
 		DateTimeActivityStarted: dateTimeActivityStarted,
+		Sequence:                sequence,
 		NextHandler:             nil,
 	}
 	if c.LastHandler == nil {
@@ -0,0 +1,141 @@
+package main
+
+import "math/rand/v2"
+
+const skipListMaxLevel = 32
+
+// skipListNode links forward on every level it takes part in and backward on
+// the bottom level only, which is enough for reverse scans.
+type skipListNode struct {
+	Key  string
+	next []*skipListNode
+	prev *skipListNode
+}
+
+// skipList is an ordered set of keys: insert, remove and seek take O(log n)
+// on average, and walking k neighbours from a found node takes O(k).
+type skipList struct {
+	head   *skipListNode
+	tail   *skipListNode
+	level  int
+	length int
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+// newSkipListSorted builds a list from sorted, unique keys in O(n) by
+// appending every node after the current last node of each of its levels.
+func newSkipListSorted(keys []string) *skipList {
+	s := newSkipList()
+	last := make([]*skipListNode, skipListMaxLevel)
+	for i := range last {
+		last[i] = s.head
+	}
+	for _, key := range keys {
+		level := randomSkipListLevel()
+		node := &skipListNode{Key: key, next: make([]*skipListNode, level), prev: s.tail}
+		for i := 0; i < level; i++ {
+			last[i].next[i] = node
+			last[i] = node
+		}
+		if level > s.level {
+			s.level = level
+		}
+		s.tail = node
+		s.length++
+	}
+	return s
+}
+
+func randomSkipListLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// predecessors returns, for every level, the last node with a key below key.
+func (s *skipList) predecessors(key string) []*skipListNode {
+	update := make([]*skipListNode, skipListMaxLevel)
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].Key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Insert adds key, which must not be in the list yet.
+func (s *skipList) Insert(key string) {
+	update := s.predecessors(key)
+	level := randomSkipListLevel()
+	for ; s.level < level; s.level++ {
+		update[s.level] = s.head
+	}
+
+	node := &skipListNode{Key: key, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	if update[0] != s.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		s.tail = node
+	}
+	s.length++
+}
+
+func (s *skipList) Remove(key string) bool {
+	update := s.predecessors(key)
+	node := update[0].next[0]
+	if node == nil || node.Key != key {
+		return false
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		s.tail = node.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+// Seek returns the first node whose key is not less than key, or nil.
+func (s *skipList) Seek(key string) *skipListNode {
+	return s.predecessors(key)[0].next[0]
+}
+
+func (s *skipList) First() *skipListNode {
+	return s.head.next[0]
+}
+
+func (s *skipList) Last() *skipListNode {
+	return s.tail
+}
+
+func (n *skipListNode) Next() *skipListNode {
+	return n.next[0]
+}
+
+func (n *skipListNode) Prev() *skipListNode {
+	return n.prev
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Snapshot pins a version of the whole PoolManager: reads through it replay
+// key chains only up to Timestamp, so writers never disturb what it sees.
+type Snapshot struct {
+	ID        string
+	Timestamp int64
+	Sequence  uint64
+}
+
+type SnapshotManager struct {
+	Snapshots map[string]*Snapshot
+	mu        sync.Mutex
+}
+
+func (pm *PoolManager) CreateSnapshot() (*Snapshot, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Waiting for running commits keeps a transaction either fully inside
+	// or fully outside the snapshot.
+	pm.commitMu.Lock()
+	timestamp, sequence := currentVersion()
+	pm.commitMu.Unlock()
+
+	snapshot := &Snapshot{ID: id, Timestamp: timestamp, Sequence: sequence}
+	pm.Snapshots.mu.Lock()
+	defer pm.Snapshots.mu.Unlock()
+	if pm.Snapshots.Snapshots == nil {
+		pm.Snapshots.Snapshots = make(map[string]*Snapshot)
+	}
+	pm.Snapshots.Snapshots[id] = snapshot
+	return snapshot, nil
+}
+
+func (pm *PoolManager) GetSnapshot(id string) (*Snapshot, error) {
+	pm.Snapshots.mu.Lock()
+	defer pm.Snapshots.mu.Unlock()
+
+	snapshot, ok := pm.Snapshots.Snapshots[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+	return snapshot, nil
+}
+
+func (pm *PoolManager) ReleaseSnapshot(id string) error {
+	pm.Snapshots.mu.Lock()
+	if _, ok := pm.Snapshots.Snapshots[id]; !ok {
+		pm.Snapshots.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+	delete(pm.Snapshots.Snapshots, id)
+	pm.Snapshots.mu.Unlock()
+
+	pm.CollectVersions()
+	return nil
+}
+
+func (s *Snapshot) Get(collection *TreeManager, key string) (interface{}, error) {
+	data, err := collection.GetAt(key, time.Unix(0, s.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+	return data.Value, nil
+}
+
+func (s *Snapshot) GetRange(collection *TreeManager, minValue, maxValue string) ([]TData, error) {
+	return collection.GetRangeAt(minValue, maxValue, time.Unix(0, s.Timestamp))
+}
+
+// versionHorizon is the newest timestamp whose older versions nobody can read
+// any more: now minus the retention window, or the oldest snapshot if earlier.
+func (pm *PoolManager) versionHorizon() int64 {
+	horizon := time.Now().Add(-pm.VersionRetention).UnixNano()
+
+	pm.Snapshots.mu.Lock()
+	defer pm.Snapshots.mu.Unlock()
+	for _, snapshot := range pm.Snapshots.Snapshots {
+		if snapshot.Timestamp < horizon {
+			horizon = snapshot.Timestamp
+		}
+	}
+	return horizon
+}
+
+// CollectVersions folds every chain prefix older than the version horizon
+// into a single insert (or drops it if the key was deleted by then) and
+// returns the number of handlers removed.
+func (pm *PoolManager) CollectVersions() int {
+	horizon := pm.versionHorizon()
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	removed := 0
+	for _, pool := range pm.Pools {
+		for _, schema := range pool.Schemas {
+			for _, collection := range schema.Collections {
+				removed += collection.compactChains(horizon)
+			}
+		}
+	}
+	return removed
+}
+
+// versionCollectionInterval is how often RunVersionCollection runs: twice per
+// retention window, so no version outlives it by more than half, but not more
+// often than once a minute.
+func versionCollectionInterval(retention time.Duration) time.Duration {
+	if retention/2 < time.Minute {
+		return time.Minute
+	}
+	return retention / 2
+}
+
+// RunVersionCollection collects old versions until the process exits, so
+// chains stay bounded without anyone sending gc-versions.
+func (pm *PoolManager) RunVersionCollection() {
+	ticker := time.NewTicker(versionCollectionInterval(pm.VersionRetention))
+	defer ticker.Stop()
+	for range ticker.C {
+		if removed := pm.CollectVersions(); removed > 0 {
+			log.Printf("Удалено старых версий: %d", removed)
+		}
+	}
+}
+
+func (tc *TreeManager) compactChains(horizon int64) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	removed := 0
+	for key, cr := range tc.Chains {
+		var dataExists bool
+		var data TData
+		var last *ChainOfResponsibilityHandler
+		folded := 0
+		h := cr.FirstHandler
+		for ; h != nil && h.DateTimeActivityStarted <= horizon; h = h.NextHandler {
+			if err := h.Command.Execute(&dataExists, &data); err != nil {
+				break
+			}
+			last = h
+			folded++
+		}
+		if last == nil || (folded == 1 && dataExists) {
+			continue
+		}
+
+		if dataExists {
+			base := &ChainOfResponsibilityHandler{
+				Command:                 &InsertCommand{InitialVersion: TData{Key: key, Value: data.Value}},
+				DateTimeActivityStarted: last.DateTimeActivityStarted,
+				Sequence:                last.Sequence,
+				NextHandler:             h,
+			}
+			cr.FirstHandler = base
+			if h == nil {
+				cr.LastHandler = base
+			}
+			removed += folded - 1
+		} else if h != nil {
+			cr.FirstHandler = h
+			removed += folded
+		} else {
+			delete(tc.Chains, key)
+			removed += folded
+		}
+	}
+	return removed
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every save file starts with a fixed header: magic, format version, CRC-32C
+// of the payload and payload length, little-endian. The payload is whatever
+// the caller wrote: JSON for the state, a pool or a schema, a key/value
+// stream for a single tree.
+const (
+	stateFileMagic      = "DBSTATE\n"
+	stateFileVersion    = 1
+	stateFileHeaderSize = 24
+)
+
+var stateFileTable = crc32.MakeTable(crc32.Castagnoli)
+
+type checksumWriter struct {
+	w      io.Writer
+	crc    hash.Hash32
+	length uint64
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.crc.Write(p[:n])
+	cw.length += uint64(n)
+	return n, err
+}
+
+// writeStateFile writes a save file so that filename holds either its
+// previous contents or the complete new ones, never a torn mix: the data goes
+// to a temp file next to it, which is synced and renamed over filename, and
+// the rename is made durable by syncing the directory.
+func writeStateFile(filename string, write func(w io.Writer) error) (err error) {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	header := make([]byte, stateFileHeaderSize)
+	if _, err = tmp.Write(header); err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(tmp)
+	cw := &checksumWriter{w: buffered, crc: crc32.New(stateFileTable)}
+	if err = write(cw); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+
+	copy(header, stateFileMagic)
+	binary.LittleEndian.PutUint32(header[8:], stateFileVersion)
+	binary.LittleEndian.PutUint32(header[12:], cw.crc.Sum32())
+	binary.LittleEndian.PutUint64(header[16:], cw.length)
+	if _, err = tmp.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readStateFile returns the payload of a save file after checking its
+// header and checksum.
+func readStateFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStateFile(filename, data, uint64(max(len(data)-stateFileHeaderSize, 0))); err != nil {
+		return nil, err
+	}
+	payload := data[stateFileHeaderSize:]
+	if crc32.Checksum(payload, stateFileTable) != binary.LittleEndian.Uint32(data[12:]) {
+		return nil, fmt.Errorf("%w: %s: контрольная сумма не совпадает", ErrCorruptedStateFile, filename)
+	}
+	return payload, nil
+}
+
+// checkStateFile checks the magic, version and payload length in header.
+func checkStateFile(filename string, header []byte, payloadSize uint64) error {
+	if len(header) < stateFileHeaderSize || string(header[:8]) != stateFileMagic {
+		return fmt.Errorf("%w: %s не является файлом сохранения", ErrCorruptedStateFile, filename)
+	}
+	if version := binary.LittleEndian.Uint32(header[8:]); version != stateFileVersion {
+		return fmt.Errorf("%w: %s: неподдерживаемая версия формата %d", ErrCorruptedStateFile, filename, version)
+	}
+	if length := binary.LittleEndian.Uint64(header[16:]); length != payloadSize {
+		return fmt.Errorf("%w: %s: ожидалось %d байт данных, найдено %d", ErrCorruptedStateFile, filename, length, payloadSize)
+	}
+	return nil
+}
+
+// extractStateFile streams the payload of a save file into a new temp file
+// in dir, checking the checksum on the way, and returns the temp file's name.
+// Unlike readStateFile it never holds the payload in memory, which is what
+// page file copies need.
+func extractStateFile(filename, dir string) (name string, err error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, stateFileHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return "", fmt.Errorf("%w: %s не является файлом сохранения", ErrCorruptedStateFile, filename)
+	}
+	if err := checkStateFile(filename, header, uint64(info.Size()-stateFileHeaderSize)); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".restore-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	crc := crc32.New(stateFileTable)
+	if _, err = io.Copy(io.MultiWriter(tmp, crc), bufio.NewReader(src)); err != nil {
+		return "", err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[12:]) {
+		err = fmt.Errorf("%w: %s: контрольная сумма не совпадает", ErrCorruptedStateFile, filename)
+		return "", err
+	}
+	if err = tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// pageCopies are the page files of disk collections checkpointed next to a
+// save file, named "<save>.<token>-<n>.pages". The token is new for every
+// save, so the copies of the previous save stay intact until the save file
+// that refers to them has been replaced.
+type pageCopies struct {
+	filename string
+	token    string
+	names    map[string]bool
+}
+
+func newPageCopies(filename string) *pageCopies {
+	return &pageCopies{
+		filename: filename,
+		token:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		names:    make(map[string]bool),
+	}
+}
+
+// add copies the page file at path and returns the copy's name relative to
+// the save file's directory. The caller keeps the file from changing.
+func (pc *pageCopies) add(path string) (string, error) {
+	name := fmt.Sprintf("%s.%s-%d.pages", filepath.Base(pc.filename), pc.token, len(pc.names))
+	err := writeStateFile(filepath.Join(filepath.Dir(pc.filename), name), func(w io.Writer) error {
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	pc.names[name] = true
+	return name, nil
+}
+
+// discard removes the copies of a save that failed.
+func (pc *pageCopies) discard() {
+	for name := range pc.names {
+		os.Remove(filepath.Join(filepath.Dir(pc.filename), name))
+	}
+}
+
+// prune removes the copies left by earlier saves to the same file.
+func (pc *pageCopies) prune() error {
+	return removePageCopies(pc.filename, pc.names)
+}
+
+// removePageCopies removes the page file copies of the save file filename
+// except those in keep.
+func removePageCopies(filename string, keep map[string]bool) error {
+	dir, prefix := filepath.Dir(filename), filepath.Base(filename)+"."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, entry := range entries {
+		name := entry.Name()
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok || keep[name] {
+			continue
+		}
+		rest, ok = strings.CutSuffix(rest, ".pages")
+		if !ok || !isPageCopyID(rest) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// isPageCopyID reports whether id has the "<token>-<n>" form of copy names,
+// which also tells them from the copies of a save named "<filename>.x".
+func isPageCopyID(id string) bool {
+	token, n, ok := strings.Cut(id, "-")
+	if !ok || token == "" || n == "" {
+		return false
+	}
+	if _, err := strconv.ParseUint(token, 36, 64); err != nil {
+		return false
+	}
+	_, err := strconv.ParseUint(n, 10, 64)
+	return err == nil
+}
+
+// saveWithPages writes the state capture returns into filename along with
+// the page file copies it made.
+func saveWithPages(filename string, capture func(copies *pageCopies) (interface{}, error)) error {
+	copies := newPageCopies(filename)
+	state, err := capture(copies)
+	if err == nil {
+		err = writeStateFile(filename, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(state)
+		})
+	}
+	if err != nil {
+		copies.discard()
+		return err
+	}
+	return copies.prune()
+}
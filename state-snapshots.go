@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// State snapshots are save-state files the server writes on its own into a
+// directory. They are unrelated to the MVCC Snapshot of snapshot.go, which
+// only pins a version in memory.
+const (
+	stateSnapshotPrefix = "state-"
+	stateSnapshotSuffix = ".snap"
+	stateSnapshotLayout = "20060102-150405.000000"
+)
+
+// StateSnapshots takes a snapshot every Interval or after Mutations
+// successful writes, whichever comes first, and keeps the newest Keep of them
+// plus the newest one of each of the last KeepDays days.
+type StateSnapshots struct {
+	Dir       string
+	Interval  time.Duration
+	Mutations int64
+	Keep      int
+	KeepDays  int
+	mutations atomic.Int64
+	kick      chan struct{}
+}
+
+type StateSnapshotInfo struct {
+	ID   string
+	Time time.Time
+	Size int64
+	Path string
+}
+
+func NewStateSnapshots(dir string, interval time.Duration, mutations int64, keep, keepDays int) (*StateSnapshots, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	return &StateSnapshots{
+		Dir:       dir,
+		Interval:  interval,
+		Mutations: mutations,
+		Keep:      keep,
+		KeepDays:  keepDays,
+		kick:      make(chan struct{}, 1),
+	}, nil
+}
+
+// noteMutation counts a successful write and wakes the snapshot loop once
+// enough of them have piled up.
+func (pm *PoolManager) noteMutation() {
+	ss := pm.StateSnapshots
+	if ss == nil {
+		return
+	}
+	if n := ss.mutations.Add(1); ss.Mutations > 0 && n >= ss.Mutations {
+		select {
+		case ss.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// RunStateSnapshots takes snapshots until the process exits. A period with
+// no writes produces no snapshot.
+func (pm *PoolManager) RunStateSnapshots() {
+	ss := pm.StateSnapshots
+	var tick <-chan time.Time
+	if ss.Interval > 0 {
+		ticker := time.NewTicker(ss.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-ss.kick:
+		}
+		if ss.mutations.Load() == 0 {
+			continue
+		}
+		if info, err := pm.TakeStateSnapshot(); err != nil {
+			log.Printf("Ошибка создания снимка состояния: %v", err)
+		} else {
+			log.Printf("Снимок состояния %s сохранен", info.ID)
+		}
+	}
+}
+
+// TakeStateSnapshot saves the state into a new snapshot and applies the
+// retention policy. Writes that land while it runs count toward the next one;
+// with a log attached they wait, so the snapshot records its log position.
+func (pm *PoolManager) TakeStateSnapshot() (StateSnapshotInfo, error) {
+	ss := pm.StateSnapshots
+	if ss == nil {
+		return StateSnapshotInfo{}, errStateSnapshotsOff()
+	}
+	if pm.WAL != nil {
+		pm.writeMu.Lock()
+		defer pm.writeMu.Unlock()
+	}
+	pending := ss.mutations.Swap(0)
+	now := time.Now().UTC()
+	info := StateSnapshotInfo{ID: now.Format(stateSnapshotLayout), Time: now}
+	info.Path = ss.path(info.ID)
+	if err := pm.SaveToFile(info.Path); err != nil {
+		ss.mutations.Add(pending)
+		return info, err
+	}
+	if stat, err := os.Stat(info.Path); err == nil {
+		info.Size = stat.Size()
+	}
+	return info, ss.prune(now)
+}
+
+func (pm *PoolManager) ListStateSnapshots() ([]StateSnapshotInfo, error) {
+	if pm.StateSnapshots == nil {
+		return nil, errStateSnapshotsOff()
+	}
+	return pm.StateSnapshots.list()
+}
+
+// RestoreStateSnapshot replaces the state with the snapshot id, like
+// load-state with the snapshot's file.
+func (pm *PoolManager) RestoreStateSnapshot(id string) error {
+	ss := pm.StateSnapshots
+	if ss == nil {
+		return errStateSnapshotsOff()
+	}
+	if _, err := time.Parse(stateSnapshotLayout, id); err != nil {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+	if err := pm.LoadFromFile(ss.path(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+		}
+		return err
+	}
+	return nil
+}
+
+func errStateSnapshotsOff() error {
+	return fmt.Errorf("%w: снимки состояния не настроены, нужен флаг -snapshot-dir", ErrInvalidArgument)
+}
+
+func (ss *StateSnapshots) path(id string) string {
+	return filepath.Join(ss.Dir, stateSnapshotPrefix+id+stateSnapshotSuffix)
+}
+
+// list returns the snapshots in the directory, oldest first. Files with
+// other names, including unfinished temp files, are skipped.
+func (ss *StateSnapshots) list() ([]StateSnapshotInfo, error) {
+	entries, err := os.ReadDir(ss.Dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]StateSnapshotInfo, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, stateSnapshotPrefix) || !strings.HasSuffix(name, stateSnapshotSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, stateSnapshotPrefix), stateSnapshotSuffix)
+		created, err := time.Parse(stateSnapshotLayout, id)
+		if err != nil {
+			continue
+		}
+		info := StateSnapshotInfo{ID: id, Time: created, Path: filepath.Join(ss.Dir, name)}
+		if stat, err := entry.Info(); err == nil {
+			info.Size = stat.Size()
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+// prune deletes the snapshots the retention policy no longer keeps.
+func (ss *StateSnapshots) prune(now time.Time) error {
+	snapshots, err := ss.list()
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for i := len(snapshots) - 1; i >= 0 && i >= len(snapshots)-ss.Keep; i-- {
+		keep[snapshots[i].ID] = true
+	}
+	oldestDay := now.AddDate(0, 0, -ss.KeepDays).Format("2006-01-02")
+	days := make(map[string]bool)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		day := snapshots[i].Time.Format("2006-01-02")
+		if day > oldestDay && !days[day] {
+			days[day] = true
+			keep[snapshots[i].ID] = true
+		}
+	}
+
+	var first error
+	for _, snapshot := range snapshots {
+		if keep[snapshot.ID] {
+			continue
+		}
+		if err := os.Remove(snapshot.Path); err != nil && first == nil {
+			first = err
+		}
+		if err := removePageCopies(snapshot.Path, nil); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentCommands runs writes, reads and DDL against one PoolManager
+// the way concurrent /run-command and /get-info requests do. Run it with
+// go test -race; it also checks that every tree is still valid afterwards.
+func TestConcurrentCommands(t *testing.T) {
+	stdout := os.Stdout
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	const (
+		workers    = 4
+		iterations = 200
+	)
+	types := []string{"avl", "redblack", "btree", "bplustree", "skiplist", "map"}
+	pools := NewPoolManager()
+	for _, command := range []string{"add-pool p", "add-schema p s"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	for _, treeType := range types {
+		if err := runCommand(pools, "add-collection p s "+treeType+" "+treeType); err != nil {
+			t.Fatal(treeType, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	run := func(fn func(worker, i int) error) {
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					if err := fn(worker, i); err != nil {
+						report(err)
+						return
+					}
+				}
+			}(worker)
+		}
+	}
+
+	// Writers own disjoint keys, so every command they send has to succeed.
+	run(func(worker, i int) error {
+		collection := types[(worker+i)%len(types)]
+		key := fmt.Sprintf("w%d-%04d", worker, i)
+		for _, command := range []string{
+			fmt.Sprintf("insert-data p s %s %s %d", collection, key, i),
+			fmt.Sprintf("update-data p s %s %s %d", collection, key, i+1),
+		} {
+			if err := runCommand(pools, command); err != nil {
+				return fmt.Errorf("%s: %w", command, err)
+			}
+		}
+		if i%3 == 0 {
+			command := fmt.Sprintf("delete-data p s %s %s", collection, key)
+			if err := runCommand(pools, command); err != nil {
+				return fmt.Errorf("%s: %w", command, err)
+			}
+		}
+		return nil
+	})
+
+	// Readers look data up while it changes; they only need not to race.
+	run(func(worker, i int) error {
+		collection, err := pools.GetCollection("p", "s", types[i%len(types)])
+		if err != nil {
+			return err
+		}
+		collection.Get(fmt.Sprintf("w%d-%04d", worker, i))
+		if _, err := collection.Range(RangeQuery{Min: "w", Max: "x", HasMin: true, HasMax: true, Limit: 50}); err != nil {
+			return err
+		}
+		pools.SchemaNames()
+		return nil
+	})
+
+	// DDL adds and drops schemas and collections next to the ones in use.
+	run(func(worker, i int) error {
+		schema := fmt.Sprintf("ddl%d", worker)
+		for _, command := range []string{
+			"add-schema p " + schema,
+			fmt.Sprintf("add-collection p %s c %s", schema, types[i%len(types)]),
+			fmt.Sprintf("insert-data p %s c k %d", schema, i),
+			"remove-collection p " + schema + " c",
+			"remove-schema p " + schema,
+		} {
+			if err := runCommand(pools, command); err != nil {
+				return fmt.Errorf("%s: %w", command, err)
+			}
+		}
+		return nil
+	})
+
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	for _, treeType := range types {
+		collection, err := pools.GetCollection("p", "s", treeType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := collection.Validate(); err != nil {
+			t.Fatalf("%s: %v", treeType, err)
+		}
+	}
+	for worker := 0; worker < workers; worker++ {
+		for i := 0; i < iterations; i++ {
+			collection, _ := pools.GetCollection("p", "s", types[(worker+i)%len(types)])
+			key := fmt.Sprintf("w%d-%04d", worker, i)
+			value, err := collection.Get(key)
+			if i%3 == 0 {
+				if err == nil {
+					t.Fatalf("%s %s: deleted key found", collection.Type, key)
+				}
+			} else if err != nil || value != fmt.Sprint(i+1) {
+				t.Fatalf("%s %s: got %v, %v", collection.Type, key, value, err)
+			}
+		}
+	}
+}
+
+// TestBufferDuringCommit keeps buffering operations while the transaction
+// commits: each one has to either make it into the commit or be refused.
+func TestBufferDuringCommit(t *testing.T) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	pools := NewPoolManager()
+	for _, command := range []string{"add-pool p", "add-schema p s", "add-collection p s c map"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	for round := 0; round < 5; round++ {
+		tx, err := pools.BeginTransaction("p", "s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			accepted []string
+		)
+		for worker := 0; worker < 4; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					key := fmt.Sprintf("r%02d-w%d-%06d", round, worker, i)
+					err := pools.BufferOperation(tx.ID, []string{"insert-data", "p", "s", "c", key, "v"})
+					if err != nil {
+						if !errors.Is(err, ErrTransactionNotFound) {
+							t.Error(err)
+						}
+						return
+					}
+					mu.Lock()
+					accepted = append(accepted, key)
+					mu.Unlock()
+				}
+			}(worker)
+		}
+		for {
+			mu.Lock()
+			n := len(accepted)
+			mu.Unlock()
+			if n >= 1000 {
+				break
+			}
+			runtime.Gosched()
+		}
+		if err := pools.CommitTransaction(tx.ID); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		collection, _ := pools.GetCollection("p", "s", "c")
+		for _, key := range accepted {
+			if _, err := collection.Get(key); err != nil {
+				t.Fatalf("%s was accepted but not committed", key)
+			}
+		}
+	}
+}
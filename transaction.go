@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type txOperation struct {
+	Args       []string
+	Collection string
+	Key        string
+	Value      string
+}
+
+// Transaction buffers data commands against the collections of one schema.
+// StartSequence is the global version at begin; any key touched by the
+// transaction that got a newer version before commit is a conflict. A disk
+// collection keeps no versions per key, so any newer write to it conflicts.
+type Transaction struct {
+	ID            string
+	Pool          string
+	Schema        string
+	StartSequence uint64
+	Operations    []txOperation
+	lastUsed      time.Time
+	closed        bool
+	mu            sync.Mutex
+}
+
+// close marks tx ended, so an operation buffered by a request that looked it
+// up before it ended is refused instead of being lost.
+func (tx *Transaction) close() {
+	tx.mu.Lock()
+	tx.closed = true
+	tx.mu.Unlock()
+}
+
+// TransactionManager drops a transaction that has not been used for
+// IdleTimeout, so a client that never commits or rolls back does not keep it
+// forever; 0 keeps transactions until they end.
+type TransactionManager struct {
+	Transactions map[string]*Transaction
+	IdleTimeout  time.Duration
+	mu           sync.Mutex
+}
+
+// idle reports whether tx has been unused for longer than IdleTimeout; the
+// caller holds mu.
+func (tm *TransactionManager) idle(tx *Transaction, now time.Time) bool {
+	return tm.IdleTimeout > 0 && now.Sub(tx.lastUsed) > tm.IdleTimeout
+}
+
+// lookup returns the open transaction id and marks it used. An idle one is
+// dropped instead; the caller holds mu.
+func (tm *TransactionManager) lookup(id string) (*Transaction, error) {
+	tx, ok := tm.Transactions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTransactionNotFound, id)
+	}
+	now := time.Now()
+	if tm.idle(tx, now) {
+		delete(tm.Transactions, id)
+		tx.close()
+		return nil, fmt.Errorf("%w: %s закрыта после простоя дольше %s", ErrTransactionNotFound, id, tm.IdleTimeout)
+	}
+	tx.lastUsed = now
+	return tx, nil
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (pm *PoolManager) BeginTransaction(poolName, schemaName string) (*Transaction, error) {
+	pm.mu.RLock()
+	pool, err := pm.getPool(poolName)
+	if err == nil {
+		_, err = pool.GetSchema(schemaName)
+	}
+	pm.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	_, sequence := currentVersion()
+	now := time.Now()
+	tx := &Transaction{
+		ID:            id,
+		Pool:          poolName,
+		Schema:        schemaName,
+		StartSequence: sequence,
+		lastUsed:      now,
+	}
+
+	pm.Transactions.mu.Lock()
+	defer pm.Transactions.mu.Unlock()
+	if pm.Transactions.Transactions == nil {
+		pm.Transactions.Transactions = make(map[string]*Transaction)
+	}
+	// Abandoned transactions are swept here, so they go away even if nobody
+	// asks for them again.
+	for openID, open := range pm.Transactions.Transactions {
+		if pm.Transactions.idle(open, now) {
+			delete(pm.Transactions.Transactions, openID)
+			open.close()
+		}
+	}
+	pm.Transactions.Transactions[id] = tx
+	return tx, nil
+}
+
+func (pm *PoolManager) getTransaction(id string) (*Transaction, error) {
+	pm.Transactions.mu.Lock()
+	defer pm.Transactions.mu.Unlock()
+	return pm.Transactions.lookup(id)
+}
+
+func (pm *PoolManager) endTransaction(id string) (*Transaction, error) {
+	pm.Transactions.mu.Lock()
+	defer pm.Transactions.mu.Unlock()
+
+	tx, err := pm.Transactions.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	delete(pm.Transactions.Transactions, id)
+	tx.close()
+	return tx, nil
+}
+
+// BufferOperation adds an insert-data, update-data or delete-data command
+// (in its usual form) to the transaction without touching the collection.
+func (pm *PoolManager) BufferOperation(id string, args []string) error {
+	tx, err := pm.getTransaction(id)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "insert-data", "update-data":
+		if len(args) < 6 {
+			return notEnoughArguments(args[0])
+		}
+	case "delete-data":
+		if len(args) < 5 {
+			return notEnoughArguments(args[0])
+		}
+	default:
+		return fmt.Errorf("%w: %s не поддерживается в транзакции", ErrUnknownCommand, args[0])
+	}
+	if args[1] != tx.Pool || args[2] != tx.Schema {
+		return fmt.Errorf("%w: транзакция %s открыта для %s %s", ErrInvalidArgument, id, tx.Pool, tx.Schema)
+	}
+	if _, err := pm.GetCollection(args[1], args[2], args[3]); err != nil {
+		return err
+	}
+
+	op := txOperation{Args: args, Collection: args[3], Key: args[4]}
+	if len(args) > 5 {
+		op.Value = args[5]
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return fmt.Errorf("%w: %s", ErrTransactionNotFound, id)
+	}
+	tx.Operations = append(tx.Operations, op)
+	return nil
+}
+
+func (pm *PoolManager) RollbackTransaction(id string) error {
+	_, err := pm.endTransaction(id)
+	return err
+}
+
+// CommitTransaction applies the buffered operations all together or not at
+// all. Every touched collection is write-locked (in name order) for the whole
+// check-and-apply, so no other writer can interleave.
+func (pm *PoolManager) CommitTransaction(id string) error {
+	tx, err := pm.endTransaction(id)
+	if err != nil {
+		return err
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if len(tx.Operations) == 0 {
+		return nil
+	}
+
+	if pm.WAL != nil {
+		pm.writeMu.Lock()
+		defer pm.writeMu.Unlock()
+	}
+	pm.commitMu.RLock()
+	defer pm.commitMu.RUnlock()
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	pool, err := pm.getPool(tx.Pool)
+	if err != nil {
+		return err
+	}
+	schema, err := pool.GetSchema(tx.Schema)
+	if err != nil {
+		return err
+	}
+
+	collections := make(map[string]*TreeManager)
+	names := make([]string, 0)
+	for _, op := range tx.Operations {
+		if _, ok := collections[op.Collection]; ok {
+			continue
+		}
+		collection, err := schema.GetCollection(op.Collection)
+		if err != nil {
+			return err
+		}
+		collections[op.Collection] = collection
+		names = append(names, op.Collection)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		collections[name].mu.Lock()
+		defer collections[name].mu.Unlock()
+	}
+
+	exists := make(map[string]bool)
+	for _, op := range tx.Operations {
+		collection := collections[op.Collection]
+		stateKey := op.Collection + "/" + op.Key
+		keyExists, seen := exists[stateKey]
+		if !seen {
+			if cr, ok := collection.Chains[op.Key]; ok && cr.LastHandler != nil && cr.LastHandler.Sequence > tx.StartSequence {
+				return fmt.Errorf("%w: %s %s", ErrTransactionConflict, op.Collection, op.Key)
+			}
+			if !collection.chained() && collection.lastWrite > tx.StartSequence {
+				return fmt.Errorf("%w: %s", ErrTransactionConflict, op.Collection)
+			}
+			_, err := collection.Tree.Get(op.Key)
+			keyExists = err == nil
+		}
+		switch op.Args[0] {
+		case "insert-data":
+			if keyExists {
+				return fmt.Errorf("%w: %s %s", ErrKeyExists, op.Collection, op.Key)
+			}
+			keyExists = true
+		case "update-data":
+			if !keyExists {
+				return fmt.Errorf("%w: %s %s", ErrKeyNotFound, op.Collection, op.Key)
+			}
+		case "delete-data":
+			if !keyExists {
+				return fmt.Errorf("%w: %s %s", ErrKeyNotFound, op.Collection, op.Key)
+			}
+			keyExists = false
+		}
+		exists[stateKey] = keyExists
+	}
+
+	commands := make([]string, 0, len(tx.Operations))
+	for _, op := range tx.Operations {
+		collection := collections[op.Collection]
+		switch op.Args[0] {
+		case "insert-data":
+			err = collection.insertData(op.Key, op.Value)
+		case "update-data":
+			err = collection.updateData(op.Key, op.Value)
+		case "delete-data":
+			err = collection.deleteData(op.Key)
+		}
+		if err != nil {
+			return err
+		}
+		commands = append(commands, strings.Join(op.Args, " "))
+	}
+
+	// Counted here rather than in runCommand, since /commit does not go
+	// through it.
+	pm.noteMutation()
+	if pm.WAL != nil {
+		if err := pm.WAL.Append(strings.Join(commands, "\n")); err != nil {
+			return fmt.Errorf("%w: %w", ErrWriteAheadLogFailed, err)
+		}
+	}
+	return nil
+}
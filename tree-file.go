@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// treeFileHeader opens every file a tree saves. It is followed by Count
+// entries, one JSON KeyValue per line in key order, so no engine has to
+// serialize its nodes (and NodeRB.Parent cannot loop the encoder). Any
+// engine can load a file written by another; Type and Order only describe
+// the engine that wrote it.
+type treeFileHeader struct {
+	Type  string
+	Order int `json:",omitempty"`
+	Count int
+}
+
+// saveTreeFile streams the entries of tree into filename.
+func saveTreeFile(filename string, header treeFileHeader, tree Iterable) error {
+	return writeStateFile(filename, func(w io.Writer) error {
+		it := tree.NewIterator()
+		for it.Next() {
+			header.Count++
+		}
+		it.Close()
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(header); err != nil {
+			return err
+		}
+		for key, value := range Scan(tree, RangeQuery{}) {
+			if err := encoder.Encode(KeyValue{Key: key, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadTreeFile reads a file written by saveTreeFile and checks that its
+// entries are sorted and complete; the caller bulk loads them.
+func loadTreeFile(filename string) (treeFileHeader, []KeyValue, error) {
+	var header treeFileHeader
+	data, err := readStateFile(filename)
+	if err != nil {
+		return header, nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&header); err != nil {
+		return header, nil, fmt.Errorf("%w: заголовок файла %s: %w", ErrCorruptedStateFile, filename, err)
+	}
+	if header.Count < 0 {
+		return header, nil, fmt.Errorf("%w: в заголовке файла %s отрицательное число записей %d", ErrCorruptedStateFile, filename, header.Count)
+	}
+	// Count only checks the result; the slice grows with the entries actually
+	// read, so a damaged header cannot make the load allocate for it.
+	pairs := make([]KeyValue, 0)
+	for {
+		var pair KeyValue
+		if err := decoder.Decode(&pair); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return header, nil, fmt.Errorf("%w: запись %d файла %s: %w", ErrCorruptedStateFile, len(pairs), filename, err)
+		}
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) != header.Count {
+		return header, nil, fmt.Errorf("%w: в файле %s %d записей вместо %d", ErrCorruptedStateFile, filename, len(pairs), header.Count)
+	}
+	if err := checkSortedPairs(pairs); err != nil {
+		return header, nil, fmt.Errorf("файл %s: %w", filename, err)
+	}
+	return header, pairs, nil
+}
+
+// loadTreeFileInto replaces the contents of tree with the entries of filename.
+func loadTreeFileInto(filename string, tree Tree) error {
+	_, pairs, err := loadTreeFile(filename)
+	if err != nil {
+		return err
+	}
+	return tree.BulkLoad(pairs)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WALSyncPolicy int
+
+const (
+	WALSyncAlways WALSyncPolicy = iota
+	WALSyncBatched
+	WALSyncNone
+)
+
+const walHeaderSize = 8
+
+// A log file starts with a header holding the sequence number of its first
+// record; records are numbered on from there, and a reset starts the file
+// over at the next number. A file from before the header existed has no magic
+// and numbers its records from 1.
+const (
+	walFileMagic      = "DBWAL01\n"
+	walFileHeaderSize = 16
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walCommands are the commands that change the PoolManager and therefore
+// have to be written to the log once they succeed.
+var walCommands = map[string]bool{
+	"add-pool":           true,
+	"remove-pool":        true,
+	"add-schema":         true,
+	"remove-schema":      true,
+	"add-collection":     true,
+	"remove-collection":  true,
+	"convert-collection": true,
+	"insert-data":        true,
+	"batch-insert":       true,
+	"update-data":        true,
+	"delete-data":        true,
+}
+
+// loadCommands replace data with the contents of a file that may change or
+// vanish later, so instead of being logged they are followed by a save over
+// StatePath and an empty log.
+var loadCommands = map[string]bool{
+	"load-state":       true,
+	"load-collection":  true,
+	"load-schema":      true,
+	"load-pool":        true,
+	"restore-snapshot": true,
+}
+
+func ParseWALSyncPolicy(name string) (WALSyncPolicy, error) {
+	switch name {
+	case "always":
+		return WALSyncAlways, nil
+	case "batched":
+		return WALSyncBatched, nil
+	case "none":
+		return WALSyncNone, nil
+	default:
+		return 0, fmt.Errorf("неизвестная политика синхронизации журнала: %s", name)
+	}
+}
+
+// WriteAheadLog is an append-only file of commands. Each record is
+// [length uint32][crc32 uint32][command], little-endian. Records get
+// consecutive sequence numbers, which a saved state uses to tell how much of
+// the log it already contains. Replay has to run before the first Append for
+// the numbers to be right.
+type WriteAheadLog struct {
+	file   *os.File
+	policy WALSyncPolicy
+	dirty  bool
+	start  int64
+	first  uint64
+	next   uint64
+	mu     sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func OpenWriteAheadLog(filename string, policy WALSyncPolicy, batchInterval time.Duration) (*WriteAheadLog, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wal := &WriteAheadLog{
+		file:   file,
+		policy: policy,
+		first:  1,
+	}
+	header := make([]byte, walFileHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	switch {
+	case n < walFileHeaderSize && errors.Is(err, io.EOF) && strings.HasPrefix(walFileMagic, string(header[:min(n, len(walFileMagic))])):
+		// A new file, or one whose header was cut short while being written.
+		if err = file.Truncate(0); err == nil {
+			err = wal.writeHeader()
+		}
+	case n == walFileHeaderSize && string(header[:8]) == walFileMagic:
+		wal.start, wal.first, err = walFileHeaderSize, binary.LittleEndian.Uint64(header[8:]), nil
+	case errors.Is(err, io.EOF):
+		err = nil
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	wal.next = wal.first
+	if policy == WALSyncBatched {
+		if batchInterval <= 0 {
+			batchInterval = time.Second
+		}
+		wal.stop = make(chan struct{})
+		wal.done = make(chan struct{})
+		go wal.syncLoop(batchInterval)
+	}
+	return wal, nil
+}
+
+func (w *WriteAheadLog) syncLoop(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				fmt.Println("Ошибка синхронизации журнала:", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *WriteAheadLog) Append(command string) error {
+	payload := []byte(command)
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, walTable))
+	copy(record[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	w.next++
+	switch w.policy {
+	case WALSyncAlways:
+		return w.file.Sync()
+	case WALSyncBatched:
+		w.dirty = true
+	}
+	return nil
+}
+
+func (w *WriteAheadLog) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// writeHeader starts the file with the sequence number of its first record;
+// the caller holds mu or owns w exclusively.
+func (w *WriteAheadLog) writeHeader() error {
+	header := make([]byte, walFileHeaderSize)
+	copy(header, walFileMagic)
+	binary.LittleEndian.PutUint64(header[8:], w.first)
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	w.start = walFileHeaderSize
+	return w.file.Sync()
+}
+
+// Sequence returns the number of the last record appended, 0 if none ever was.
+func (w *WriteAheadLog) Sequence() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.next - 1
+}
+
+// Replay feeds every intact record numbered after covered, the last record
+// the loaded state contains, to apply in order, and stops at the first one
+// apply rejects: the records after it were written on top of its effect. A
+// log that starts after covered+1 has lost records the state does not have
+// and is refused. A torn record at the end of the file is cut off so that
+// new records are appended after the last good one; a damaged record in the
+// middle of the log is reported as an error, and so is a zero-filled stretch
+// with intact records after it.
+func (w *WriteAheadLog) Replay(covered uint64, apply func(command string) error) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.first > covered+1 {
+		return 0, fmt.Errorf("журнал начинается с записи %d, а состояние содержит записи только до %d", w.first, covered)
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if _, err := w.file.Seek(w.start, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(w.file)
+	header := make([]byte, walHeaderSize)
+	offset := w.start
+	replayed := 0
+	for offset < size {
+		if size-offset < walHeaderSize {
+			break
+		}
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return replayed, err
+		}
+		length := int64(binary.LittleEndian.Uint32(header[0:4]))
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		end := offset + walHeaderSize + length
+		// No command is empty, so a zero length is the zero-filled tail a
+		// crash can leave behind an append, not a record.
+		if length == 0 || end > size {
+			rest := make([]byte, size-offset-walHeaderSize)
+			if _, err := io.ReadFull(reader, rest); err != nil {
+				return replayed, err
+			}
+			if containsWALRecord(rest) {
+				return replayed, fmt.Errorf("повреждена длина записи журнала на смещении %d", offset)
+			}
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return replayed, err
+		}
+		if crc32.Checksum(payload, walTable) != checksum {
+			if end == size {
+				break
+			}
+			return replayed, fmt.Errorf("повреждена запись журнала на смещении %d", offset)
+		}
+		if w.next > covered {
+			if err := apply(string(payload)); err != nil {
+				return replayed, fmt.Errorf("запись журнала %d на смещении %d (%q): %w", w.next, offset, payload, err)
+			}
+			replayed++
+		}
+		w.next++
+		offset = end
+	}
+
+	if offset < size {
+		fmt.Printf("Обрезана неполная запись в конце журнала (%d байт)\n", size-offset)
+		if err := w.file.Truncate(offset); err != nil {
+			return replayed, err
+		}
+		if err := w.file.Sync(); err != nil {
+			return replayed, err
+		}
+	}
+	if w.next <= covered {
+		// The state holds every record, so numbering goes on after it.
+		w.next = covered + 1
+		return replayed, w.reset()
+	}
+	_, err = w.file.Seek(offset, io.SeekStart)
+	return replayed, err
+}
+
+// containsWALRecord reports whether an intact record starts anywhere in
+// data. A record whose length runs past the end of the log is a torn append
+// only if nothing intact follows it; otherwise its length is damaged.
+func containsWALRecord(data []byte) bool {
+	for i := 0; i+walHeaderSize < len(data); i++ {
+		length := int(binary.LittleEndian.Uint32(data[i : i+4]))
+		end := i + walHeaderSize + length
+		if length == 0 || end > len(data) {
+			continue
+		}
+		if crc32.Checksum(data[i+walHeaderSize:end], walTable) == binary.LittleEndian.Uint32(data[i+4:i+8]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reset empties the log. It is called after the state the log is replayed
+// on top of has been saved again, since everything logged so far is already
+// contained in it. Numbering goes on where it stopped.
+func (w *WriteAheadLog) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reset()
+}
+
+func (w *WriteAheadLog) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.first = w.next
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(w.start, io.SeekStart); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *WriteAheadLog) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// SaveState saves the state into filename. The log holds the commands since
+// StatePath, the file loaded at startup, so it is emptied only when that file
+// is the one overwritten; a save anywhere else leaves it alone. Writes wait
+// for the save and the reset, so nothing lands between them.
+func (pm *PoolManager) SaveState(filename string) error {
+	if pm.WAL == nil {
+		return pm.SaveToFile(filename)
+	}
+	pm.writeMu.Lock()
+	defer pm.writeMu.Unlock()
+	if err := pm.SaveToFile(filename); err != nil {
+		return err
+	}
+	if pm.StatePath == "" || !samePath(pm.StatePath, filename) {
+		return nil
+	}
+	return pm.WAL.Reset()
+}
+
+// checkLoad refuses a load that could not be made durable: with a log
+// attached there has to be a StatePath to save the loaded data into.
+func (pm *PoolManager) checkLoad() error {
+	if pm.WAL != nil && pm.StatePath == "" {
+		return fmt.Errorf("%w: при включенном журнале загрузка требует флага -load-state", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// checkpoint saves the state over StatePath and empties the log after a
+// load; the caller holds writeMu.
+func (pm *PoolManager) checkpoint() error {
+	if pm.WAL == nil {
+		return nil
+	}
+	if err := pm.SaveToFile(pm.StatePath); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteAheadLogFailed, err)
+	}
+	if err := pm.WAL.Reset(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteAheadLogFailed, err)
+	}
+	return nil
+}
+
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+func (pm *PoolManager) logCommand(args []string) error {
+	if pm.WAL == nil || !walCommands[args[0]] {
+		return nil
+	}
+	if err := pm.WAL.Append(strings.Join(args, " ")); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteAheadLogFailed, err)
+	}
+	return nil
+}
+
+// replayRecord applies one log record. A committed transaction is stored as a
+// single record with one command per line.
+func (pm *PoolManager) replayRecord(record string) error {
+	for _, command := range strings.Split(record, "\n") {
+		if err := runCommand(pm, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func silenceStdout(t *testing.T) {
+	t.Helper()
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	t.Cleanup(func() { os.Stdout = stdout })
+}
+
+func openTestWAL(t *testing.T, path string) *WriteAheadLog {
+	t.Helper()
+	wal, err := OpenWriteAheadLog(path, WALSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wal.Close() })
+	return wal
+}
+
+// TestWALFirstRun saves the state of a server started without -load-state
+// and restarts it on that file and the same log, which still holds the
+// commands the save contains.
+func TestWALFirstRun(t *testing.T) {
+	silenceStdout(t)
+	dir := t.TempDir()
+	save := filepath.Join(dir, "state")
+	pools := NewPoolManager()
+	pools.WAL = openTestWAL(t, filepath.Join(dir, "wal"))
+	for _, command := range []string{"add-pool p", "add-schema p s", "add-collection p s c avl", "insert-data p s c a 1", "save-state " + save, "insert-data p s c b 2"} {
+		if err := runCommand(pools, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	pools.WAL.Close()
+
+	restarted := NewPoolManager()
+	if err := restarted.LoadFromFile(save); err != nil {
+		t.Fatal(err)
+	}
+	restarted.StatePath = save
+	wal := openTestWAL(t, filepath.Join(dir, "wal"))
+	replayed, err := wal.Replay(restarted.LoadedSequence, restarted.replayRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.WAL = wal
+	if replayed != 1 {
+		t.Fatalf("replayed %d records, want 1", replayed)
+	}
+	collection, _ := restarted.GetCollection("p", "s", "c")
+	if value, err := collection.Get("b"); err != nil || value != "2" {
+		t.Fatalf("b = %v, %v", value, err)
+	}
+
+	// Saving over the loaded file empties the log; the records after it go
+	// on being numbered from where the save stopped.
+	for _, command := range []string{"save-state " + save, "insert-data p s c d 4"} {
+		if err := runCommand(restarted, command); err != nil {
+			t.Fatal(command, err)
+		}
+	}
+	wal.Close()
+
+	again := NewPoolManager()
+	if err := again.LoadFromFile(save); err != nil {
+		t.Fatal(err)
+	}
+	wal = openTestWAL(t, filepath.Join(dir, "wal"))
+	if _, err := wal.Replay(0, NewPoolManager().replayRecord); err == nil {
+		t.Fatal("replayed a log that starts after the records of an empty state")
+	}
+	if _, err := wal.Replay(again.LoadedSequence, again.replayRecord); err != nil {
+		t.Fatal(err)
+	}
+	collection, _ = again.GetCollection("p", "s", "c")
+	if value, err := collection.Get("d"); err != nil || value != "4" {
+		t.Fatalf("d = %v, %v", value, err)
+	}
+}
+
+func TestWALZeroTail(t *testing.T) {
+	silenceStdout(t)
+	path := filepath.Join(t.TempDir(), "wal")
+	wal := openTestWAL(t, path)
+	wal.Append("add-pool a")
+	wal.Close()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(make([]byte, 4096))
+	file.Close()
+
+	var commands []string
+	wal = openTestWAL(t, path)
+	if _, err := wal.Replay(0, func(command string) error {
+		commands = append(commands, command)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 {
+		t.Fatalf("replayed %q", commands)
+	}
+	if info, _ := os.Stat(path); info.Size() != walFileHeaderSize+walHeaderSize+int64(len("add-pool a")) {
+		t.Fatalf("log is %d bytes after the zero tail was cut off", info.Size())
+	}
+}
+
+func appendTestRecords(t *testing.T, path string, commands ...string) {
+	t.Helper()
+	wal, err := OpenWriteAheadLog(path, WALSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if _, err := wal.Replay(0, func(string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range commands {
+		if err := wal.Append(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func replayTestLog(t *testing.T, path string) ([]string, error) {
+	t.Helper()
+	var commands []string
+	_, err := openTestWAL(t, path).Replay(0, func(command string) error {
+		commands = append(commands, command)
+		return nil
+	})
+	return commands, err
+}
+
+func TestWALTornTail(t *testing.T) {
+	silenceStdout(t)
+	path := filepath.Join(t.TempDir(), "wal")
+	appendTestRecords(t, path, "add-pool a", "add-pool b", "add-pool c")
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	commands, err := replayTestLog(t, path)
+	if err != nil || len(commands) != 2 {
+		t.Fatalf("replayed %q, %v", commands, err)
+	}
+	// The next append lands after the last intact record.
+	appendTestRecords(t, path, "add-pool d")
+	commands, err = replayTestLog(t, path)
+	if err != nil || len(commands) != 3 || commands[2] != "add-pool d" {
+		t.Fatalf("replayed %q, %v", commands, err)
+	}
+}
+
+// TestWALCorruption damages the first of three records in each way a log
+// can break; intact records after the damage make it an error, not a tail.
+func TestWALCorruption(t *testing.T) {
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "wal")
+	appendTestRecords(t, clean, "add-pool a", "add-pool b", "add-pool c")
+	data, err := os.ReadFile(clean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := walFileHeaderSize
+	damages := map[string]func(data []byte){
+		"length":  func(data []byte) { data[record+1] = 0x40 },
+		"payload": func(data []byte) { data[record+walHeaderSize] ^= 0xff },
+		"zeroed": func(data []byte) {
+			for i := record; i < record+walHeaderSize+len("add-pool a"); i++ {
+				data[i] = 0
+			}
+		},
+	}
+	for name, damage := range damages {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			damaged := append([]byte(nil), data...)
+			damage(damaged)
+			if err := os.WriteFile(path, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if commands, err := replayTestLog(t, path); err == nil {
+				t.Fatalf("replayed %q from a damaged log", commands)
+			}
+		})
+	}
+}
+
+func TestWALReplayStopsOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	appendTestRecords(t, path, "add-pool a", "add-pool b", "add-pool c")
+	var commands []string
+	replayed, err := openTestWAL(t, path).Replay(0, func(command string) error {
+		if command == "add-pool b" {
+			return ErrKeyExists
+		}
+		commands = append(commands, command)
+		return nil
+	})
+	if !errors.Is(err, ErrKeyExists) || replayed != 1 || len(commands) != 1 {
+		t.Fatalf("replayed %d (%q), %v", replayed, commands, err)
+	}
+}
+
+// TestWALLegacyFile replays a log written before files got a header.
+func TestWALLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	appendTestRecords(t, path, "add-pool a", "add-pool b")
+	data, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, data[walFileHeaderSize:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	commands, err := replayTestLog(t, path)
+	if err != nil || len(commands) != 2 {
+		t.Fatalf("replayed %q, %v", commands, err)
+	}
+}
+
+func TestWALSyncPolicies(t *testing.T) {
+	for _, name := range []string{"always", "batched", "none"} {
+		t.Run(name, func(t *testing.T) {
+			policy, err := ParseWALSyncPolicy(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "wal")
+			wal, err := OpenWriteAheadLog(path, policy, 10*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.Append("add-pool a"); err != nil {
+				t.Fatal(err)
+			}
+			wal.mu.Lock()
+			dirty := wal.dirty
+			wal.mu.Unlock()
+			// Only the batched policy leaves the append to its sync loop,
+			// which has to get to it within a few intervals.
+			if dirty != (policy == WALSyncBatched) {
+				t.Fatalf("dirty = %v after append", dirty)
+			}
+			for deadline := time.Now().Add(time.Second); dirty && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				wal.mu.Lock()
+				dirty = wal.dirty
+				wal.mu.Unlock()
+			}
+			if dirty {
+				t.Fatal("the sync loop never synced the append")
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if commands, err := replayTestLog(t, path); err != nil || len(commands) != 1 {
+				t.Fatalf("replayed %q, %v", commands, err)
+			}
+		})
+	}
+	if _, err := ParseWALSyncPolicy("sometimes"); err == nil {
+		t.Fatal("accepted an unknown sync policy")
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type StringPoolManager struct {
@@ -38,20 +44,110 @@ func (sp *StringPoolManager) Get(str string) string {
 	return str
 }
 
+type KeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+// checkSortedPairs is the precondition of BulkLoad: strictly increasing keys.
+func checkSortedPairs(pairs []KeyValue) error {
+	for i := 1; i < len(pairs); i++ {
+		if pairs[i-1].Key >= pairs[i].Key {
+			return fmt.Errorf("%w: ключи должны быть отсортированы и уникальны: %s", ErrInvalidArgument, pairs[i].Key)
+		}
+	}
+	return nil
+}
+
 type Tree interface {
 	Insert(key string, value interface{}) error
 	Get(key string) (interface{}, error)
 	GetRange(minValue, maxValue string) ([]string, error)
+	Range(query RangeQuery) ([]KeyValue, error)
+	NewIterator() Iterator
+	Count(minValue, maxValue string) (int, error)
+	Rank(key string) (int, error)
+	Select(position int) (KeyValue, error)
+	Validate() error
+	BulkLoad(pairs []KeyValue) error
 	Update(key string, value interface{}) error
 	Remove(key string) error
+	Walk(fn func(key string, value interface{}))
 	SaveToFile(filename string) error
+	LoadFromFile(filename string) error
 }
 
+// TreeManager guards its tree and key chains with mu: reads share the lock,
+// writes take it exclusively.
 type TreeManager struct {
-	Tree Tree
+	Type    string
+	Options TreeOptions
+	Tree    Tree
+	Chains  map[string]*ChainOfResponsibility
+	mu      sync.RWMutex
+	// lockFree is Tree when the engine serves concurrent readers itself;
+	// readers load it instead of taking mu.
+	lockFree atomic.Pointer[Tree]
+	// dirty collects the keys written while the collection is being
+	// converted to another engine; nil otherwise.
+	dirty map[string]struct{}
+	// lastWrite is the version of the newest write to a collection without
+	// chains, which transactions check instead of a key's chain.
+	lastWrite uint64
 }
 
-func NewTreeManager(treeType string) *TreeManager {
+// TreeOptions are the engine settings given to add-collection as name=value
+// pairs after the tree type, e.g. "order=64" for a btree or bplustree, or
+// "path=data.pages cache=256" for a disk collection.
+type TreeOptions struct {
+	Order int    `json:",omitempty"`
+	Path  string `json:",omitempty"`
+	Cache int    `json:",omitempty"`
+}
+
+func ParseTreeOptions(args []string) (TreeOptions, error) {
+	var options TreeOptions
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return options, fmt.Errorf("%w: ожидается параметр вида имя=значение: %s", ErrInvalidArgument, arg)
+		}
+		switch name {
+		case "order":
+			order, err := strconv.Atoi(value)
+			if err != nil || order < 2 {
+				return options, fmt.Errorf("%w: порядок дерева должен быть целым числом не меньше 2: %s", ErrInvalidArgument, value)
+			}
+			options.Order = order
+		case "path":
+			if value == "" {
+				return options, fmt.Errorf("%w: путь к файлу страниц не задан", ErrInvalidArgument)
+			}
+			options.Path = value
+		case "cache":
+			cache, err := strconv.Atoi(value)
+			if err != nil || cache < 1 {
+				return options, fmt.Errorf("%w: размер кэша должен быть положительным числом страниц: %s", ErrInvalidArgument, value)
+			}
+			options.Cache = cache
+		default:
+			return options, fmt.Errorf("%w: неизвестный параметр коллекции: %s", ErrInvalidArgument, name)
+		}
+	}
+	return options, nil
+}
+
+func NewTreeManager(treeType string) (*TreeManager, error) {
+	return NewTreeManagerWithOptions(treeType, TreeOptions{})
+}
+
+func NewTreeManagerWithOptions(treeType string, options TreeOptions) (*TreeManager, error) {
+	if options.Order != 0 && treeType != "btree" && treeType != "bplustree" {
+		return nil, fmt.Errorf("%w: параметр order задается только для btree и bplustree", ErrInvalidArgument)
+	}
+	if (options.Path != "" || options.Cache != 0) && treeType != "disk" {
+		return nil, fmt.Errorf("%w: параметры path и cache задаются только для disk", ErrInvalidArgument)
+	}
 	var tree Tree
 	switch treeType {
 	case "avl":
@@ -59,54 +155,502 @@ func NewTreeManager(treeType string) *TreeManager {
 	case "redblack":
 		tree = NewRedBlackTree()
 	case "btree":
-		tree = NewBTree()
+		if options.Order == 0 {
+			options.Order = defaultBTreeOrder
+		}
+		tree = NewBTreeOrder(options.Order)
+	case "bplustree":
+		if options.Order == 0 {
+			options.Order = defaultBTreeOrder
+		}
+		tree = NewBPlusTreeOrder(options.Order)
+	case "skiplist":
+		tree = NewConcurrentSkipList()
+	case "disk":
+		if options.Path == "" {
+			return nil, fmt.Errorf("%w: для коллекции disk нужен параметр path", ErrInvalidArgument)
+		}
+		if options.Cache == 0 {
+			options.Cache = defaultDiskCachePages
+		}
+		// A new collection starts empty even if the file holds pages: when
+		// the log is replayed, the data comes back from the commands after
+		// add-collection, not from what the file held at the crash.
+		disk, err := CreateDiskBTree(options.Path, options.Cache)
+		if err != nil {
+			return nil, err
+		}
+		tree = disk
 	default:
+		treeType = "map"
 		tree = NewMapCollection()
 	}
-	return &TreeManager{Tree: tree}
+	return newTreeManager(treeType, options, tree), nil
+}
+
+func newTreeManager(treeType string, options TreeOptions, tree Tree) *TreeManager {
+	tc := &TreeManager{
+		Type:    treeType,
+		Options: options,
+		Chains:  make(map[string]*ChainOfResponsibility),
+	}
+	tc.setTree(tree)
+	return tc
+}
+
+// setTree installs tree; the caller holds mu or owns tc exclusively.
+func (tc *TreeManager) setTree(tree Tree) {
+	tc.Tree = tree
+	if _, ok := tree.(concurrentReader); ok {
+		tc.lockFree.Store(&tree)
+	} else {
+		tc.lockFree.Store(nil)
+	}
+}
+
+// touch records a write to key for a conversion in progress.
+func (tc *TreeManager) touch(key string) {
+	if tc.dirty != nil {
+		tc.dirty[key] = struct{}{}
+	}
 }
 
 func (tc *TreeManager) Insert(key string, value interface{}) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.touch(key)
 	return tc.Tree.Insert(key, value)
 }
 
+// readTree returns the tree to read and the matching unlock: engines that
+// serve concurrent readers are read without taking the lock.
+func (tc *TreeManager) readTree() (Tree, func()) {
+	if tree := tc.lockFree.Load(); tree != nil {
+		return *tree, func() {}
+	}
+	tc.mu.RLock()
+	return tc.Tree, tc.mu.RUnlock
+}
+
 func (tc *TreeManager) Get(key string) (interface{}, error) {
-	return tc.Tree.Get(key)
+	tree, unlock := tc.readTree()
+	defer unlock()
+	return tree.Get(key)
 }
 
 func (tc *TreeManager) GetRange(minValue, maxValue string) ([]string, error) {
-	return tc.Tree.GetRange(minValue, maxValue)
+	tree, unlock := tc.readTree()
+	defer unlock()
+	return tree.GetRange(minValue, maxValue)
+}
+
+func (tc *TreeManager) Range(query RangeQuery) ([]KeyValue, error) {
+	tree, unlock := tc.readTree()
+	defer unlock()
+	return tree.Range(query)
+}
+
+func (tc *TreeManager) Count(minValue, maxValue string) (int, error) {
+	tree, unlock := tc.readTree()
+	defer unlock()
+	return tree.Count(minValue, maxValue)
+}
+
+func (tc *TreeManager) Rank(key string) (int, error) {
+	tree, unlock := tc.readTree()
+	defer unlock()
+	return tree.Rank(key)
+}
+
+func (tc *TreeManager) Select(position int) (KeyValue, error) {
+	tree, unlock := tc.readTree()
+	defer unlock()
+	return tree.Select(position)
+}
+
+func (tc *TreeManager) Validate() error {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.Tree.Validate()
 }
 
 func (tc *TreeManager) Update(key string, value interface{}) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.touch(key)
 	return tc.Tree.Update(key, value)
 }
 
 func (tc *TreeManager) Remove(key string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.touch(key)
 	return tc.Tree.Remove(key)
 }
 
+// chained reports whether the collection keeps a command chain per key. A
+// disk collection does not, so that its memory use does not grow with its
+// data; it has no key history and no point-in-time reads.
+func (tc *TreeManager) chained() bool {
+	_, onDisk := tc.Tree.(flusher)
+	return !onDisk
+}
+
+// record appends command to the chain of key, or only moves lastWrite on for
+// a collection without chains.
+func (tc *TreeManager) record(key string, command Command) {
+	if !tc.chained() {
+		_, tc.lastWrite = nextVersion()
+		return
+	}
+	tc.chain(key).AddHandler(command)
+}
+
+func errNoHistory(treeType string) error {
+	return fmt.Errorf("%w: коллекция типа %s не хранит историю ключей", ErrInvalidArgument, treeType)
+}
+
+func (tc *TreeManager) chain(key string) *ChainOfResponsibility {
+	cr, ok := tc.Chains[key]
+	if !ok {
+		cr = &ChainOfResponsibility{}
+		tc.Chains[key] = cr
+	}
+	return cr
+}
+
+func (tc *TreeManager) InsertData(key string, value interface{}) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.insertData(key, value)
+}
+
+func (tc *TreeManager) insertData(key string, value interface{}) error {
+	if err := tc.Tree.Insert(key, value); err != nil {
+		return err
+	}
+	tc.touch(key)
+	tc.record(key, &InsertCommand{InitialVersion: TData{Key: key, Value: value, Timestamp: time.Now()}})
+	return nil
+}
+
+// BulkInsert adds all pairs or none of them. An empty collection is built
+// directly from the sorted pairs; a filled one gets them inserted one by one.
+func (tc *TreeManager) BulkInsert(pairs []KeyValue) error {
+	pairs = append([]KeyValue(nil), pairs...)
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	for i := 1; i < len(pairs); i++ {
+		if pairs[i-1].Key == pairs[i].Key {
+			return fmt.Errorf("%w: ключ %s повторяется в пакете", ErrKeyExists, pairs[i].Key)
+		}
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for _, pair := range pairs {
+		if _, err := tc.Tree.Get(pair.Key); err == nil {
+			return fmt.Errorf("%w: %s", ErrKeyExists, pair.Key)
+		}
+	}
+	if it := tc.Tree.NewIterator(); !it.Next() {
+		it.Close()
+		if err := tc.Tree.BulkLoad(pairs); err != nil {
+			return err
+		}
+	} else {
+		it.Close()
+		for _, pair := range pairs {
+			if err := tc.Tree.Insert(pair.Key, pair.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, pair := range pairs {
+		tc.touch(pair.Key)
+		tc.record(pair.Key, &InsertCommand{InitialVersion: TData{Key: pair.Key, Value: pair.Value, Timestamp: now}})
+	}
+	return nil
+}
+
+func (tc *TreeManager) UpdateData(key string, value string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.updateData(key, value)
+}
+
+func (tc *TreeManager) updateData(key string, value string) error {
+	if err := tc.Tree.Update(key, value); err != nil {
+		return err
+	}
+	tc.touch(key)
+	tc.record(key, &UpdateCommand{UpdateExpression: value})
+	return nil
+}
+
+func (tc *TreeManager) DeleteData(key string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.deleteData(key)
+}
+
+func (tc *TreeManager) deleteData(key string) error {
+	if err := tc.Tree.Remove(key); err != nil {
+		return err
+	}
+	tc.touch(key)
+	tc.record(key, &DisposeCommand{})
+	return nil
+}
+
+// Replay rebuilds the state of key from its command chain as of dateTimeTarget.
+func (tc *TreeManager) Replay(key string, dateTimeTarget int64) (TData, bool, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.replay(key, dateTimeTarget)
+}
+
+func (tc *TreeManager) replay(key string, dateTimeTarget int64) (TData, bool, error) {
+	var dataExists bool
+	var data TData
+	if !tc.chained() {
+		return data, false, errNoHistory(tc.Type)
+	}
+	cr, ok := tc.Chains[key]
+	if !ok || cr.FirstHandler == nil {
+		return data, false, nil
+	}
+	if err := cr.FirstHandler.Handle(&dataExists, &data, dateTimeTarget); err != nil {
+		return data, false, fmt.Errorf("%w: %w", ErrCorruptedChain, err)
+	}
+	return data, dataExists, nil
+}
+
+func (tc *TreeManager) Walk(fn func(key string, value interface{})) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	tc.Tree.Walk(fn)
+}
+
 func (tc *TreeManager) SaveToFile(filename string) error {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
 	return tc.Tree.SaveToFile(filename)
 }
 
+// LoadFromFile replaces the entries with those of a file written by
+// SaveToFile. The key history does not survive: every loaded key starts a new
+// chain with its loaded value.
+func (tc *TreeManager) LoadFromFile(filename string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.dirty != nil {
+		return fmt.Errorf("%w: коллекция конвертируется", ErrInvalidArgument)
+	}
+	if err := tc.Tree.LoadFromFile(filename); err != nil {
+		return err
+	}
+	tc.resetChains()
+	return nil
+}
+
+// resetChains starts a chain for every key from its current value; the
+// caller holds mu or owns tc exclusively.
+func (tc *TreeManager) resetChains() {
+	tc.Chains = make(map[string]*ChainOfResponsibility)
+	if !tc.chained() {
+		return
+	}
+	tc.Tree.Walk(func(key string, value interface{}) {
+		tc.chain(key).AddHandler(&InsertCommand{InitialVersion: TData{Key: key, Value: value, Timestamp: time.Now()}})
+	})
+}
+
+// flusher is implemented by engines that keep their data in a file.
+type flusher interface {
+	Flush() error
+}
+
+// Close releases the file behind a disk collection; other engines have
+// nothing to release.
+func (tc *TreeManager) Close() error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if closer, ok := tc.Tree.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// treeManagerState is the on-disk form of a TreeManager: the engine type
+// plus its entries in key order, so any engine can be rebuilt by re-inserting.
+// A disk collection, which may not fit in memory, is saved as a copy of its
+// page file next to the save file instead; Pages names the copy.
+type treeManagerState struct {
+	Type    string
+	Options TreeOptions
+	Entries []KeyValue `json:",omitempty"`
+	Pages   string     `json:",omitempty"`
+}
+
+// state copies the entries, or the page file, under the read lock, so
+// encoding them can happen after writers get the collection back.
+func (tc *TreeManager) state(copies *pageCopies) (treeManagerState, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	state := treeManagerState{Type: tc.Type, Options: tc.Options}
+	if f, ok := tc.Tree.(flusher); ok {
+		// Once flushed, the file does not change while the read lock is
+		// held: readers only evict clean pages.
+		if err := f.Flush(); err != nil {
+			return state, err
+		}
+		name, err := copies.add(tc.Options.Path)
+		state.Pages = name
+		return state, err
+	}
+	state.Entries = make([]KeyValue, 0)
+	if tc.Tree != nil {
+		tc.Tree.Walk(func(key string, value interface{}) {
+			state.Entries = append(state.Entries, KeyValue{Key: key, Value: value})
+		})
+	}
+	return state, nil
+}
+
+// newTreeManagerFromState builds a collection from its saved form. A disk
+// collection gets its page file from staged, see stagePageFiles, or, in a
+// save that holds its entries, has the file rewritten with them; either way
+// the caller makes sure no other collection has that file open.
+func newTreeManagerFromState(state treeManagerState, staged map[string]string) (*TreeManager, error) {
+	if state.Pages != "" {
+		return restoreDiskCollection(state, staged)
+	}
+	tc, err := NewTreeManagerWithOptions(state.Type, state.Options)
+	if err != nil {
+		return nil, err
+	}
+	if !tc.chained() {
+		if err := tc.Tree.BulkLoad(state.Entries); err != nil {
+			tc.Close()
+			return nil, fmt.Errorf("коллекция типа %s: %w", tc.Type, err)
+		}
+		return tc, nil
+	}
+	for _, entry := range state.Entries {
+		if err := tc.insertData(entry.Key, entry.Value); err != nil {
+			tc.Close()
+			return nil, fmt.Errorf("коллекция типа %s: ключ %s: %w", tc.Type, entry.Key, err)
+		}
+	}
+	return tc, nil
+}
+
+// restoreDiskCollection moves the staged copy of the page file into place
+// and opens it.
+func restoreDiskCollection(state treeManagerState, staged map[string]string) (*TreeManager, error) {
+	tmp, ok := staged[state.Pages]
+	if !ok {
+		return nil, fmt.Errorf("%w: копия страниц %s не подготовлена", ErrCorruptedStateFile, state.Pages)
+	}
+	if err := os.Rename(tmp, state.Options.Path); err != nil {
+		return nil, err
+	}
+	delete(staged, state.Pages)
+	if err := syncDir(filepath.Dir(state.Options.Path)); err != nil {
+		return nil, err
+	}
+	if state.Options.Cache == 0 {
+		state.Options.Cache = defaultDiskCachePages
+	}
+	disk, err := OpenDiskBTree(state.Options.Path, state.Options.Cache)
+	if err != nil {
+		return nil, err
+	}
+	return newTreeManager("disk", state.Options, disk), nil
+}
+
+// stagePageFiles checks and copies the page files of the saved disk
+// collections in states next to where they go, before any collection is
+// closed, so a damaged copy fails the load without touching anything. The
+// result maps each copy to its staged file.
+func stagePageFiles(dir string, states []treeManagerState) (map[string]string, error) {
+	staged := make(map[string]string)
+	for _, state := range states {
+		if state.Type != "disk" || state.Options.Path == "" || filepath.Base(state.Pages) != state.Pages {
+			discardStaged(staged)
+			return nil, fmt.Errorf("%w: неверная копия страниц %s", ErrCorruptedStateFile, state.Pages)
+		}
+		tmp, err := extractStateFile(filepath.Join(dir, state.Pages), filepath.Dir(state.Options.Path))
+		if err != nil {
+			discardStaged(staged)
+			return nil, fmt.Errorf("копия страниц %s: %w", state.Pages, err)
+		}
+		staged[state.Pages] = tmp
+	}
+	return staged, nil
+}
+
+// discardStaged removes the staged files a load did not use.
+func discardStaged(staged map[string]string) {
+	for _, tmp := range staged {
+		os.Remove(tmp)
+	}
+}
+
+// reopen opens the page file of a disk collection closed by Close again;
+// other collections are left as they are.
+func (tc *TreeManager) reopen() error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.Tree.(flusher); !ok {
+		return nil
+	}
+	tree, err := OpenDiskBTree(tc.Options.Path, tc.Options.Cache)
+	if err != nil {
+		return err
+	}
+	tc.setTree(tree)
+	return nil
+}
+
+// MapCollection keeps values in a Go map for O(1) point lookups and the keys
+// in a skip list, so ranges come back sorted in O(log n + k).
 type MapCollection struct {
-	Data map[string]interface{}
+	Data  map[string]interface{}
+	index *skipList
 }
 
 func NewMapCollection() *MapCollection {
 	return &MapCollection{
-		Data: make(map[string]interface{}),
+		Data:  make(map[string]interface{}),
+		index: newSkipList(),
 	}
 }
 
+// keys returns the key index, building it from Data for a collection that was
+// filled directly (e.g. decoded from JSON).
+func (mc *MapCollection) keys() *skipList {
+	if mc.index == nil || mc.index.length != len(mc.Data) {
+		mc.index = newSkipList()
+		for key := range mc.Data {
+			mc.index.Insert(key)
+		}
+	}
+	return mc.index
+}
+
 func (mc *MapCollection) Insert(key string, value interface{}) error {
 	sp := GetStringPoolManager()
 	key = sp.Get(key)
 
 	if _, exists := mc.Data[key]; exists {
-		return errors.New("Элемент с таким ключом уже существует!")
+		return ErrKeyExists
 	}
+	mc.keys().Insert(key)
 	mc.Data[key] = value
 	fmt.Println("Элемент успешно добавлен с ключом", key)
 	return nil
@@ -118,7 +662,7 @@ func (mc *MapCollection) Get(key string) (interface{}, error) {
 
 	value, exists := mc.Data[key]
 	if !exists {
-		return nil, errors.New("Элемент не найден!")
+		return nil, ErrKeyNotFound
 	}
 	return value, nil
 }
@@ -129,20 +673,128 @@ func (mc *MapCollection) GetRange(minValue, maxValue string) ([]string, error) {
 	maxValue = sp.Get(maxValue)
 
 	var result []string
-	for key := range mc.Data {
-		if key >= minValue && key <= maxValue {
-			result = append(result, key)
-		}
+	for node := mc.keys().Seek(minValue); node != nil && node.Key <= maxValue; node = node.Next() {
+		result = append(result, node.Key)
+	}
+	return result, nil
+}
+
+func (mc *MapCollection) Range(query RangeQuery) ([]KeyValue, error) {
+	result := make([]KeyValue, 0)
+	for key, value := range Scan(mc, query) {
+		result = append(result, KeyValue{Key: key, Value: value})
 	}
 	return result, nil
 }
 
+// mapIterator walks the key index and reads values from the map.
+type mapIterator struct {
+	collection *MapCollection
+	node       *skipListNode
+}
+
+func (mc *MapCollection) NewIterator() Iterator {
+	return &mapIterator{collection: mc}
+}
+
+func (it *mapIterator) Seek(key string) bool {
+	it.node = it.collection.keys().Seek(key)
+	return it.node != nil
+}
+
+func (it *mapIterator) Next() bool {
+	if it.node == nil {
+		it.node = it.collection.keys().First()
+	} else {
+		it.node = it.node.Next()
+	}
+	return it.node != nil
+}
+
+func (it *mapIterator) Prev() bool {
+	if it.node == nil {
+		it.node = it.collection.keys().Last()
+	} else {
+		it.node = it.node.Prev()
+	}
+	return it.node != nil
+}
+
+func (it *mapIterator) Key() string {
+	return it.node.Key
+}
+
+func (it *mapIterator) Value() interface{} {
+	return it.collection.Data[it.node.Key]
+}
+
+func (it *mapIterator) Close() {
+	it.node = nil
+}
+
+func (mc *MapCollection) Count(minValue, maxValue string) (int, error) {
+	return countByScan(mc, minValue, maxValue)
+}
+
+func (mc *MapCollection) Rank(key string) (int, error) {
+	return rankByScan(mc, key)
+}
+
+func (mc *MapCollection) Select(position int) (KeyValue, error) {
+	return selectByScan(mc, position)
+}
+
+// Validate checks that the key index holds exactly the keys of Data, in
+// order and with consistent backward links.
+func (mc *MapCollection) Validate() error {
+	if mc.index == nil {
+		return nil
+	}
+	count := 0
+	var prev *skipListNode
+	for node := mc.index.First(); node != nil; node = node.Next() {
+		path := "index." + node.Key
+		if prev != nil && node.Key <= prev.Key {
+			return corruptedAt(path, "ключ нарушает порядок")
+		}
+		if node.Prev() != prev {
+			return corruptedAt(path, "неверная обратная ссылка")
+		}
+		if _, ok := mc.Data[node.Key]; !ok {
+			return corruptedAt(path, "ключа нет в данных")
+		}
+		prev = node
+		count++
+	}
+	if mc.index.Last() != prev {
+		return corruptedAt("index", "неверный последний элемент")
+	}
+	if count != len(mc.Data) || count != mc.index.length {
+		return corruptedAt("index", "%d ключей в индексе, %d в данных", count, len(mc.Data))
+	}
+	return nil
+}
+
+func (mc *MapCollection) BulkLoad(pairs []KeyValue) error {
+	if err := checkSortedPairs(pairs); err != nil {
+		return err
+	}
+	mc.Data = make(map[string]interface{}, len(pairs))
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		mc.Data[pair.Key] = pair.Value
+		keys = append(keys, pair.Key)
+	}
+	mc.index = newSkipListSorted(keys)
+	return nil
+}
+
 func (mc *MapCollection) Update(key string, value interface{}) error {
 	sp := GetStringPoolManager()
 	key = sp.Get(key)
 
 	if _, exists := mc.Data[key]; !exists {
-		return errors.New("Элемент не найден!")
+		return ErrKeyNotFound
 	}
 	mc.Data[key] = value
 	fmt.Println("Значение элемента с ключом", key, "успешно обновлено.")
@@ -154,30 +806,42 @@ func (mc *MapCollection) Remove(key string) error {
 	key = sp.Get(key)
 
 	if _, exists := mc.Data[key]; !exists {
-		return errors.New("Элемент не найден!")
+		return ErrKeyNotFound
 	}
+	mc.keys().Remove(key)
 	delete(mc.Data, key)
 	return nil
 }
 
-func (mc *MapCollection) SaveToFile(filename string) error {
-	data, err := json.Marshal(mc.Data)
-	if err != nil {
-		return err
+func (mc *MapCollection) Walk(fn func(key string, value interface{})) {
+	for node := mc.keys().First(); node != nil; node = node.Next() {
+		fn(node.Key, mc.Data[node.Key])
 	}
+}
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+func (mc *MapCollection) SaveToFile(filename string) error {
+	return saveTreeFile(filename, treeFileHeader{Type: "map"}, mc)
+}
 
-	_, err = file.Write(data)
-	return err
+func (mc *MapCollection) LoadFromFile(filename string) error {
+	return loadTreeFileInto(filename, mc)
 }
 
+// PoolManager.mu protects the pool, schema and collection maps: DDL commands
+// take it exclusively, lookups share it. Data inside a collection is guarded
+// by the collection's own lock, which is always taken after this one.
 type PoolManager struct {
-	Pools map[string]*Pool
+	Pools            map[string]*Pool
+	WAL              *WriteAheadLog     `json:"-"`
+	Transactions     TransactionManager `json:"-"`
+	Snapshots        SnapshotManager    `json:"-"`
+	VersionRetention time.Duration      `json:"-"`
+	StateSnapshots   *StateSnapshots    `json:"-"`
+	StatePath        string             `json:"-"`
+	LoadedSequence   uint64             `json:"-"`
+	mu               sync.RWMutex
+	writeMu          sync.Mutex
+	commitMu         sync.RWMutex
 }
 
 func NewPoolManager() *PoolManager {
@@ -187,6 +851,12 @@ func NewPoolManager() *PoolManager {
 }
 
 func (pm *PoolManager) ShowAll() {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	pm.showAll()
+}
+
+func (pm *PoolManager) showAll() {
 	fmt.Println("Текущие пулы и схемы:")
 	for poolName, pool := range pm.Pools {
 		fmt.Printf("Пул: %s\n", poolName)
@@ -197,16 +867,22 @@ func (pm *PoolManager) ShowAll() {
 }
 
 func (pm *PoolManager) AddPool(name string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
 	if _, exists := pm.Pools[name]; exists {
 		fmt.Println("Пул с именем", name, "уже существует.")
 	} else {
 		pm.Pools[name] = NewPool()
 		fmt.Println("Добавлен пул с именем", name)
 	}
-	pm.ShowAll()
+	pm.showAll()
 }
 
 func (pm *PoolManager) RemovePool(name string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
 	if pool, exists := pm.Pools[name]; exists {
 		for schemaName := range pool.Schemas {
 			schema := pool.Schemas[schemaName]
@@ -220,18 +896,106 @@ func (pm *PoolManager) RemovePool(name string) {
 	} else {
 		fmt.Println("Пул с именем", name, "не существует.")
 	}
-	pm.ShowAll()
+	pm.showAll()
 }
 
 func (pm *PoolManager) GetPool(name string) (*Pool, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.getPool(name)
+}
+
+func (pm *PoolManager) getPool(name string) (*Pool, error) {
 	pool, ok := pm.Pools[name]
 	if !ok {
-		return nil, errors.New("Элемент не найден!")
+		return nil, fmt.Errorf("%w: %s", ErrPoolNotFound, name)
 	}
 	return pool, nil
 }
 
+func (pm *PoolManager) AddSchema(poolName, schemaName string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pool, err := pm.getPool(poolName)
+	if err != nil {
+		return err
+	}
+	pool.AddSchema(schemaName)
+	return nil
+}
+
+func (pm *PoolManager) RemoveSchema(poolName, schemaName string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pool, err := pm.getPool(poolName)
+	if err != nil {
+		return err
+	}
+	pool.RemoveSchema(schemaName)
+	return nil
+}
+
+func (pm *PoolManager) AddCollection(poolName, schemaName, collectionName string, collection *TreeManager) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pool, err := pm.getPool(poolName)
+	if err != nil {
+		return err
+	}
+	return pool.AddCollection(schemaName, collectionName, collection)
+}
+
+func (pm *PoolManager) RemoveCollection(poolName, schemaName, collectionName string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pool, err := pm.getPool(poolName)
+	if err != nil {
+		return err
+	}
+	schema, err := pool.GetSchema(schemaName)
+	if err != nil {
+		return err
+	}
+	schema.RemoveCollection(collectionName)
+	return nil
+}
+
+func (pm *PoolManager) GetCollection(poolName, schemaName, collectionName string) (*TreeManager, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	pool, err := pm.getPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := pool.GetSchema(schemaName)
+	if err != nil {
+		return nil, err
+	}
+	return schema.GetCollection(collectionName)
+}
+
+func (pm *PoolManager) SchemaNames() map[string][]string {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	names := make(map[string][]string)
+	for poolName, pool := range pm.Pools {
+		for schemaName := range pool.Schemas {
+			names[poolName] = append(names[poolName], schemaName)
+		}
+	}
+	return names
+}
+
 func (pm *PoolManager) GetRange(minValue, maxValue string) ([]*Pool, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
 	var result []*Pool
 	for name, pool := range pm.Pools {
 		if name >= minValue && name <= maxValue {
@@ -241,22 +1005,307 @@ func (pm *PoolManager) GetRange(minValue, maxValue string) ([]*Pool, error) {
 	return result, nil
 }
 
+// poolManagerState mirrors the JSON form of a PoolManager with the
+// collections already copied out, see captureState.
+// LogSequence is the last log record the state contains; replay on top of it
+// starts after that record.
+type poolManagerState struct {
+	Pools       map[string]poolState
+	LogSequence uint64 `json:",omitempty"`
+}
+
+type poolState struct {
+	Schemas map[string]schemaState
+}
+
+type schemaState struct {
+	Collections map[string]treeManagerState
+}
+
+// pageFiles lists the saved disk collections whose page files were copied.
+func (state poolManagerState) pageFiles() []treeManagerState {
+	result := make([]treeManagerState, 0)
+	for _, pool := range state.Pools {
+		result = append(result, pool.pageFiles()...)
+	}
+	return result
+}
+
+func (state poolState) pageFiles() []treeManagerState {
+	result := make([]treeManagerState, 0)
+	for _, schema := range state.Schemas {
+		result = append(result, schema.pageFiles()...)
+	}
+	return result
+}
+
+func (state schemaState) pageFiles() []treeManagerState {
+	result := make([]treeManagerState, 0)
+	for _, collection := range state.Collections {
+		if collection.Pages != "" {
+			result = append(result, collection)
+		}
+	}
+	return result
+}
+
+// captureState copies the entries of every collection, each under its own
+// read lock, so a writer waits only while its collection is copied and never
+// for the encoding or the disk. Holding commitMu keeps every transaction
+// wholly in or wholly out of the copy. With a log attached the caller holds
+// writeMu, so the copy contains exactly the records up to LogSequence.
+func (pm *PoolManager) captureState(copies *pageCopies) (poolManagerState, error) {
+	pm.commitMu.Lock()
+	defer pm.commitMu.Unlock()
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	state := poolManagerState{Pools: make(map[string]poolState, len(pm.Pools))}
+	if pm.WAL != nil {
+		state.LogSequence = pm.WAL.Sequence()
+	}
+	for poolName, pool := range pm.Pools {
+		poolCopy, err := pool.state(copies)
+		if err != nil {
+			return state, fmt.Errorf("пул %s: %w", poolName, err)
+		}
+		state.Pools[poolName] = poolCopy
+	}
+	return state, nil
+}
+
 func (pm *PoolManager) SaveToFile(filename string) error {
-	data, err := json.Marshal(pm)
+	return saveWithPages(filename, func(copies *pageCopies) (interface{}, error) {
+		return pm.captureState(copies)
+	})
+}
+
+func (pm *PoolManager) LoadFromFile(filename string) error {
+	data, err := readStateFile(filename)
+	if err != nil {
+		return err
+	}
+	var state poolManagerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	staged, err := stagePageFiles(filepath.Dir(filename), state.pageFiles())
 	if err != nil {
 		return err
 	}
+	defer discardStaged(staged)
 
-	file, err := os.Create(filename)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pools := make(map[string]*Pool, len(state.Pools))
+	err = replaceCollections(collections(pm.eachCollection), func() error {
+		for poolName, poolState := range state.Pools {
+			pool, err := poolState.build(staged)
+			if err != nil {
+				return fmt.Errorf("пул %s: %w", poolName, err)
+			}
+			pools[poolName] = pool
+		}
+		return nil
+	}, func() {
+		for _, pool := range pools {
+			pool.eachCollection(func(collection *TreeManager) error { return collection.Close() })
+		}
+	})
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	pm.Pools = pools
+	pm.LoadedSequence = state.LogSequence
+	return nil
+}
 
-	_, err = file.Write(data)
+// replaceCollections closes the collections being replaced, writing out
+// their pages, and then runs build, all under the caller's write lock on the
+// PoolManager: no write can reach an old disk collection after its last
+// flush, and a new one never opens a page file an old one still holds. If
+// build fails, discard drops what it built and the old collections are
+// opened again.
+func replaceCollections(old []*TreeManager, build func() error, discard func()) error {
+	closed := make([]*TreeManager, 0, len(old))
+	var err error
+	for _, collection := range old {
+		closed = append(closed, collection)
+		if err = collection.Close(); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		if err = build(); err != nil {
+			discard()
+		}
+	}
+	if err != nil {
+		for _, collection := range closed {
+			if reopenErr := collection.reopen(); reopenErr != nil {
+				return fmt.Errorf("%w; прежняя коллекция не открыта заново: %w", err, reopenErr)
+			}
+		}
+	}
 	return err
 }
 
+// collections lists what eachCollection visits.
+func collections(each func(fn func(collection *TreeManager) error) error) []*TreeManager {
+	result := make([]*TreeManager, 0)
+	each(func(collection *TreeManager) error {
+		result = append(result, collection)
+		return nil
+	})
+	return result
+}
+
+func (pm *PoolManager) SavePool(poolName, filename string) error {
+	return saveWithPages(filename, func(copies *pageCopies) (interface{}, error) {
+		pm.commitMu.Lock()
+		defer pm.commitMu.Unlock()
+		pm.mu.RLock()
+		defer pm.mu.RUnlock()
+
+		pool, err := pm.getPool(poolName)
+		if err != nil {
+			return nil, err
+		}
+		return pool.state(copies)
+	})
+}
+
+// LoadPool replaces the pool with the one saved in filename, creating it if
+// it does not exist.
+func (pm *PoolManager) LoadPool(poolName, filename string) error {
+	data, err := readStateFile(filename)
+	if err != nil {
+		return err
+	}
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	staged, err := stagePageFiles(filepath.Dir(filename), state.pageFiles())
+	if err != nil {
+		return err
+	}
+	defer discardStaged(staged)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var old []*TreeManager
+	if pool, exists := pm.Pools[poolName]; exists {
+		old = collections(pool.eachCollection)
+	}
+	var loaded *Pool
+	err = replaceCollections(old, func() error {
+		loaded, err = state.build(staged)
+		return err
+	}, func() {})
+	if err != nil {
+		return err
+	}
+	pm.Pools[poolName] = loaded
+	return nil
+}
+
+func (pm *PoolManager) SaveSchema(poolName, schemaName, filename string) error {
+	return saveWithPages(filename, func(copies *pageCopies) (interface{}, error) {
+		pm.commitMu.Lock()
+		defer pm.commitMu.Unlock()
+		pm.mu.RLock()
+		defer pm.mu.RUnlock()
+
+		pool, err := pm.getPool(poolName)
+		if err != nil {
+			return nil, err
+		}
+		schema, err := pool.GetSchema(schemaName)
+		if err != nil {
+			return nil, err
+		}
+		return schema.state(copies)
+	})
+}
+
+// LoadSchema replaces the schema with the one saved in filename, creating it
+// in the pool if it does not exist.
+func (pm *PoolManager) LoadSchema(poolName, schemaName, filename string) error {
+	data, err := readStateFile(filename)
+	if err != nil {
+		return err
+	}
+	var state schemaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	staged, err := stagePageFiles(filepath.Dir(filename), state.pageFiles())
+	if err != nil {
+		return err
+	}
+	defer discardStaged(staged)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pool, err := pm.getPool(poolName)
+	if err != nil {
+		return err
+	}
+	var old []*TreeManager
+	if schema, exists := pool.Schemas[schemaName]; exists {
+		old = collections(schema.eachCollection)
+	}
+	var loaded *Schema
+	err = replaceCollections(old, func() error {
+		loaded, err = state.build(staged)
+		return err
+	}, func() {})
+	if err != nil {
+		return err
+	}
+	pool.Schemas[schemaName] = loaded
+	return nil
+}
+
+// Close closes every collection, writing out the pages of disk ones. It is
+// called on shutdown; the PoolManager is not used afterwards.
+func (pm *PoolManager) Close() error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.eachCollection(func(collection *TreeManager) error { return collection.Close() })
+}
+
+// checkDiskPath refuses a page file an open disk collection already uses:
+// a new disk collection starts by emptying its file.
+func (pm *PoolManager) checkDiskPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.eachCollection(func(collection *TreeManager) error {
+		collection.mu.RLock()
+		defer collection.mu.RUnlock()
+		if collection.Options.Path != "" && samePath(collection.Options.Path, path) {
+			return fmt.Errorf("%w: файл страниц %s уже занят открытой коллекцией", ErrInvalidArgument, path)
+		}
+		return nil
+	})
+}
+
+// eachCollection runs fn on every collection and returns the first error;
+// the caller holds mu.
+func (pm *PoolManager) eachCollection(fn func(collection *TreeManager) error) error {
+	var first error
+	for _, pool := range pm.Pools {
+		if err := pool.eachCollection(fn); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 type Pool struct {
 	Schemas map[string]*Schema
 }
@@ -267,10 +1316,35 @@ func NewPool() *Pool {
 	}
 }
 
+// build creates the pool a poolState describes. On error the collections it
+// already opened are closed again.
+func (state poolState) build(staged map[string]string) (*Pool, error) {
+	pool := NewPool()
+	for schemaName, schemaState := range state.Schemas {
+		schema, err := schemaState.build(staged)
+		if err != nil {
+			pool.eachCollection(func(collection *TreeManager) error { return collection.Close() })
+			return nil, fmt.Errorf("схема %s: %w", schemaName, err)
+		}
+		pool.Schemas[schemaName] = schema
+	}
+	return pool, nil
+}
+
+func (p *Pool) eachCollection(fn func(collection *TreeManager) error) error {
+	var first error
+	for _, schema := range p.Schemas {
+		if err := schema.eachCollection(fn); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 func (p *Pool) GetSchema(schemaName string) (*Schema, error) {
 	schema, ok := p.Schemas[schemaName]
 	if !ok {
-		return nil, errors.New("Элемент не найден!")
+		return nil, fmt.Errorf("%w: %s", ErrSchemaNotFound, schemaName)
 	}
 	return schema, nil
 }
@@ -305,48 +1379,67 @@ func (p *Pool) ShowSchemas() {
 	}
 }
 
-func (p *Pool) SaveToFile(filename string) error {
-	data, err := json.Marshal(p)
-	if err != nil {
-		return err
-	}
-
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+func (p *Pool) state(copies *pageCopies) (poolState, error) {
+	state := poolState{Schemas: make(map[string]schemaState, len(p.Schemas))}
+	for schemaName, schema := range p.Schemas {
+		schemaCopy, err := schema.state(copies)
+		if err != nil {
+			return state, fmt.Errorf("схема %s: %w", schemaName, err)
+		}
+		state.Schemas[schemaName] = schemaCopy
 	}
-	defer file.Close()
-
-	_, err = file.Write(data)
-	return err
+	return state, nil
 }
 
 type Schema struct {
-	Collections map[string]TreeManager
+	Collections map[string]*TreeManager
 }
 
 func NewSchema() *Schema {
 	return &Schema{
-		Collections: make(map[string]TreeManager),
+		Collections: make(map[string]*TreeManager),
+	}
+}
+
+func (state schemaState) build(staged map[string]string) (*Schema, error) {
+	schema := NewSchema()
+	for collectionName, collectionState := range state.Collections {
+		collection, err := newTreeManagerFromState(collectionState, staged)
+		if err != nil {
+			schema.eachCollection(func(collection *TreeManager) error { return collection.Close() })
+			return nil, fmt.Errorf("коллекция %s: %w", collectionName, err)
+		}
+		schema.Collections[collectionName] = collection
+	}
+	return schema, nil
+}
+
+func (s *Schema) eachCollection(fn func(collection *TreeManager) error) error {
+	var first error
+	for _, collection := range s.Collections {
+		if err := fn(collection); err != nil && first == nil {
+			first = err
+		}
 	}
+	return first
 }
 
-func (s *Schema) GetCollection(name string) (TreeManager, error) {
+func (s *Schema) GetCollection(name string) (*TreeManager, error) {
 	collection, ok := s.Collections[name]
 	if !ok {
-		return TreeManager{}, errors.New("Элемент не найден!")
+		return nil, fmt.Errorf("%w: %s", ErrCollectionNotFound, name)
 	}
 	return collection, nil
 }
 
-func (p *Pool) AddCollection(schemaName, collectionName string, collection TreeManager) error {
+func (p *Pool) AddCollection(schemaName, collectionName string, collection *TreeManager) error {
 	schema, err := p.GetSchema(schemaName)
 	if err != nil {
 		return err
 	}
 
 	if _, exists := schema.Collections[collectionName]; exists {
-		return errors.New("Коллекция с таким именем уже существует!")
+		return fmt.Errorf("%w: %s", ErrCollectionExists, collectionName)
 	}
 
 	schema.Collections[collectionName] = collection
@@ -356,7 +1449,10 @@ func (p *Pool) AddCollection(schemaName, collectionName string, collection TreeM
 }
 
 func (s *Schema) RemoveCollection(name string) {
-	if _, exists := s.Collections[name]; exists {
+	if collection, exists := s.Collections[name]; exists {
+		if err := collection.Close(); err != nil {
+			fmt.Println("Ошибка при закрытии коллекции", name+":", err)
+		}
 		delete(s.Collections, name)
 		fmt.Println("Коллекция с именем", name, "удалена из схемы.")
 	} else {
@@ -372,18 +1468,14 @@ func (s *Schema) ShowCollections() {
 	}
 }
 
-func (s *Schema) SaveToFile(filename string) error {
-	data, err := json.Marshal(s)
-	if err != nil {
-		return err
-	}
-
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+func (s *Schema) state(copies *pageCopies) (schemaState, error) {
+	state := schemaState{Collections: make(map[string]treeManagerState, len(s.Collections))}
+	for collectionName, collection := range s.Collections {
+		collectionCopy, err := collection.state(copies)
+		if err != nil {
+			return state, fmt.Errorf("коллекция %s: %w", collectionName, err)
+		}
+		state.Collections[collectionName] = collectionCopy
 	}
-	defer file.Close()
-
-	_, err = file.Write(data)
-	return err
+	return state, nil
 }